@@ -0,0 +1,35 @@
+package containerimage
+
+import (
+	"context"
+
+	"github.com/docker/docker/layer"
+	"github.com/moby/buildkit/cache"
+	"github.com/pkg/errors"
+)
+
+// layerChainRef returns a ref for the layer chainID of the layer store, with
+// a lazy record for each layer of its chain, so that layers already pulled by
+// the daemon are reused without downloading them into the content store. It
+// returns a nil ref if the layer store doesn't have the layer.
+func (p *puller) layerChainRef(ctx context.Context, chainID layer.ChainID, opts ...cache.RefOption) (cache.ImmutableRef, error) {
+	l, err := p.is.LayerStore.Get(chainID)
+	if err != nil {
+		if errors.Is(err, layer.ErrLayerDoesNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer layer.ReleaseAndLog(p.is.LayerStore, l)
+
+	// take the diffIDs from the layer store rather than the image config so
+	// that the records match the layers the snapshotter will mount
+	var diffIDs []layer.DiffID
+	for cur := layer.Layer(l); cur != nil; cur = cur.Parent() {
+		diffIDs = append([]layer.DiffID{cur.DiffID()}, diffIDs...)
+	}
+	if layer.CreateChainID(diffIDs) != chainID {
+		return nil, errors.Errorf("layer chain of %s has mismatching diffIDs", chainID)
+	}
+	return p.getRef(ctx, diffIDs, opts...)
+}
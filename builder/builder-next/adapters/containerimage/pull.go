@@ -348,21 +348,18 @@ func (p *puller) CacheKey(ctx context.Context, g session.Group, index int) (stri
 	return k, k, nil, true, nil
 }
 
+// getRef returns the ref of the layer chain diffIDs, creating the records of
+// all its missing layers at once.
 func (p *puller) getRef(ctx context.Context, diffIDs []layer.DiffID, opts ...cache.RefOption) (cache.ImmutableRef, error) {
-	var parent cache.ImmutableRef
-	if len(diffIDs) > 1 {
-		var err error
-		parent, err = p.getRef(ctx, diffIDs[:len(diffIDs)-1], opts...)
-		if err != nil {
-			return nil, err
+	manifest := ocispec.Manifest{Layers: make([]ocispec.Descriptor, len(diffIDs))}
+	for i, diffID := range diffIDs {
+		manifest.Layers[i] = ocispec.Descriptor{
+			Annotations: map[string]string{
+				"containerd.io/uncompressed": diffID.String(),
+			},
 		}
-		defer parent.Release(context.TODO())
 	}
-	return p.is.CacheAccessor.GetByBlob(ctx, ocispec.Descriptor{
-		Annotations: map[string]string{
-			"containerd.io/uncompressed": diffIDs[len(diffIDs)-1].String(),
-		},
-	}, parent, opts...)
+	return p.is.CacheAccessor.GetByManifest(ctx, manifest, opts...)
 }
 
 func (p *puller) Snapshot(ctx context.Context, g session.Group) (cache.ImmutableRef, error) {
@@ -382,12 +379,22 @@ func (p *puller) Snapshot(ctx context.Context, g session.Group) (cache.Immutable
 			l, err := p.is.LayerStore.Get(img.RootFS.ChainID())
 			if err == nil {
 				layer.ReleaseAndLog(p.is.LayerStore, l)
-				ref, err := p.getRef(ctx, img.RootFS.DiffIDs, cache.WithDescription(fmt.Sprintf("from local %s", p.ref)))
+				ref, err := p.getRef(ctx, img.RootFS.DiffIDs, cache.WithDescription(fmt.Sprintf("from local %s", p.ref)), cache.WithPlatform(p.platform))
 				if err != nil {
 					return nil, err
 				}
 				return ref, nil
 			}
+		} else if img, err := image.NewFromJSON(p.config); err == nil && img.RootFS != nil && len(img.RootFS.DiffIDs) > 0 {
+			// the image isn't in the image store, but its layers may
+			// have been pulled for another image
+			ref, err := p.layerChainRef(ctx, img.RootFS.ChainID(), cache.WithDescription(fmt.Sprintf("from local layers of %s", p.ref)), cache.WithPlatform(p.platform))
+			if err != nil {
+				return nil, err
+			}
+			if ref != nil {
+				return ref, nil
+			}
 		}
 	}
 
@@ -569,7 +576,7 @@ func (p *puller) Snapshot(ctx context.Context, g session.Group) (cache.Immutable
 		return nil, err
 	}
 
-	ref, err := p.getRef(ctx, rootFS.DiffIDs, cache.WithDescription(fmt.Sprintf("pulled from %s", p.ref)))
+	ref, err := p.getRef(ctx, rootFS.DiffIDs, cache.WithDescription(fmt.Sprintf("pulled from %s", p.ref)), cache.WithPlatform(p.platform))
 	release()
 	if err != nil {
 		return nil, err
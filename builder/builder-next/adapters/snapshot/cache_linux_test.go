@@ -0,0 +1,1084 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/archive"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/diff/walking"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/mount"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/cache/config"
+	"github.com/moby/buildkit/cache/metadata"
+	"github.com/moby/buildkit/cache/remotecache"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/snapshot"
+	containerdsnapshot "github.com/moby/buildkit/snapshot/containerd"
+	"github.com/moby/buildkit/util/compression"
+	"github.com/moby/buildkit/util/leaseutil"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	bolt "go.etcd.io/bbolt"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+	"gotest.tools/v3/poll"
+)
+
+type testCache struct {
+	ctx context.Context
+	cm  cache.Manager
+	md  *metadata.Store
+	cs  content.Store
+	lm  leases.Manager
+}
+
+// newTestCache returns a cache manager set up like the one of the builder,
+// on an overlay2 graph driver, with the options of opt that aren't set up.
+// Unlike the builder, which exports layers through the layer store, it has
+// the walking differ so that blobs can be computed.
+func newTestCache(t *testing.T, opt cache.ManagerOpt) *testCache {
+	ts := newTestSnapshotter(t)
+	md, err := metadata.NewStore(filepath.Join(ts.root, "metadata_v2.db"))
+	assert.NilError(t, err)
+
+	opt.Snapshotter = ts.sn
+	opt.MetadataStore = md
+	opt.LeaseManager = ts.lm
+	opt.ContentStore = containerdsnapshot.NewContentStore(ts.mdb.ContentStore(), "buildkit")
+	opt.GarbageCollect = ts.mdb.GarbageCollect
+	opt.Differ = walking.NewWalkingDiff(opt.ContentStore)
+	cm, err := cache.NewManager(opt)
+	assert.NilError(t, err)
+	t.Cleanup(func() { cm.Close() })
+
+	return &testCache{ctx: context.Background(), cm: cm, md: md, cs: opt.ContentStore, lm: ts.lm}
+}
+
+// newRef returns a finalized ref on top of parent with the files written to
+// it, keyed by path. The parent dirs of the files are created as needed.
+func (tc *testCache) newRef(t *testing.T, parent cache.ImmutableRef, files map[string][]byte) cache.ImmutableRef {
+	t.Helper()
+	active, err := tc.cm.New(tc.ctx, parent, nil, cache.CachePolicyRetain)
+	assert.NilError(t, err)
+	mntable, err := active.Mount(tc.ctx, false, nil)
+	assert.NilError(t, err)
+	mounts, release, err := mntable.Mount()
+	assert.NilError(t, err)
+	err = mount.WithTempMount(tc.ctx, mounts, func(root string) error {
+		for p, dt := range files {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(root, p)), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(root, p), dt, 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	release()
+	assert.NilError(t, err)
+	ref, err := active.Commit(tc.ctx)
+	assert.NilError(t, err)
+	assert.NilError(t, ref.Finalize(tc.ctx))
+	return ref
+}
+
+// mount mounts ref read-only, creating its snapshot if it's lazy.
+func (tc *testCache) mount(t *testing.T, ref cache.ImmutableRef) {
+	t.Helper()
+	mntable, err := ref.Mount(tc.ctx, true, nil)
+	assert.NilError(t, err)
+	_, release, err := mntable.Mount()
+	assert.NilError(t, err)
+	assert.NilError(t, release())
+}
+
+// readFile returns the contents of the file p of ref.
+func (tc *testCache) readFile(t *testing.T, ref cache.ImmutableRef, p string) string {
+	t.Helper()
+	mntable, err := ref.Mount(tc.ctx, true, nil)
+	assert.NilError(t, err)
+	mounts, release, err := mntable.Mount()
+	assert.NilError(t, err)
+	defer release()
+	var dt []byte
+	assert.NilError(t, mount.WithTempMount(tc.ctx, mounts, func(root string) error {
+		dt, err = os.ReadFile(filepath.Join(root, p))
+		return err
+	}))
+	return string(dt)
+}
+
+// mergeResults returns the number of recorded merge results.
+func (tc *testCache) mergeResults(t *testing.T) int {
+	t.Helper()
+	var n int
+	assert.NilError(t, tc.md.DB().View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte("_merge_results")); b != nil {
+			n = b.Stats().KeyN
+		}
+		return nil
+	}))
+	return n
+}
+
+func (tc *testCache) trashed(t *testing.T) []string {
+	t.Helper()
+	trash, err := tc.cm.Trash(tc.ctx)
+	assert.NilError(t, err)
+	var ids []string
+	for _, r := range trash {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+// writeUncompressedLayer writes to the content store an uncompressed layer
+// holding the file foo.
+func (tc *testCache) writeUncompressedLayer(ctx context.Context, t *testing.T) ocispecs.Descriptor {
+	t.Helper()
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Name: "foo", Mode: 0644, Size: 3, Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte("foo"))
+	assert.NilError(t, err)
+	assert.NilError(t, tw.Close())
+	desc := ocispecs.Descriptor{
+		MediaType: ocispecs.MediaTypeImageLayer,
+		Digest:    digest.FromBytes(layer.Bytes()),
+		Size:      int64(layer.Len()),
+	}
+	assert.NilError(t, content.WriteBlob(ctx, tc.cs, desc.Digest.String(), bytes.NewReader(layer.Bytes()), desc))
+	return desc
+}
+
+// testApplier extracts the uncompressed layers of cs, the builder has no
+// applier as it extracts layers through the layer store.
+type testApplier struct {
+	cs content.Provider
+}
+
+func (a *testApplier) Apply(ctx context.Context, desc ocispecs.Descriptor, mounts []mount.Mount, opts ...diff.ApplyOpt) (ocispecs.Descriptor, error) {
+	ra, err := a.cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return ocispecs.Descriptor{}, err
+	}
+	defer ra.Close()
+	var size int64
+	err = mount.WithTempMount(ctx, mounts, func(root string) error {
+		size, err = archive.Apply(ctx, root, content.NewReader(ra))
+		return err
+	})
+	return ocispecs.Descriptor{MediaType: ocispecs.MediaTypeImageLayer, Digest: desc.Digest, Size: size}, err
+}
+
+func TestCacheTrash(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{TrashRetention: time.Hour})
+
+	ref := tc.newRef(t, nil, map[string][]byte{"foo": bytes.Repeat([]byte{1}, 1<<20)})
+	id := ref.ID()
+	assert.NilError(t, ref.Release(tc.ctx))
+
+	assert.NilError(t, tc.cm.Prune(tc.ctx, nil, client.PruneInfo{All: true}))
+	assert.Check(t, is.DeepEqual(tc.trashed(t), []string{id}))
+	_, err := tc.cm.Get(tc.ctx, id, nil)
+	assert.Check(t, is.ErrorContains(err, "in the trash"))
+
+	assert.NilError(t, tc.cm.Restore(tc.ctx, id))
+	assert.Check(t, is.Len(tc.trashed(t), 0))
+	ref, err = tc.cm.Get(tc.ctx, id, nil)
+	assert.NilError(t, err)
+	assert.NilError(t, ref.Release(tc.ctx))
+}
+
+func TestCacheTrashKeepBytes(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{TrashRetention: time.Hour})
+
+	ref := tc.newRef(t, nil, map[string][]byte{"foo": bytes.Repeat([]byte{1}, 1<<20)})
+	trashedID := ref.ID()
+	assert.NilError(t, ref.Release(tc.ctx))
+	assert.NilError(t, tc.cm.Prune(tc.ctx, nil, client.PruneInfo{All: true}))
+	assert.Check(t, is.DeepEqual(tc.trashed(t), []string{trashedID}))
+
+	ref = tc.newRef(t, nil, map[string][]byte{"bar": bytes.Repeat([]byte{2}, 1<<20)})
+	liveID := ref.ID()
+	assert.NilError(t, ref.Release(tc.ctx))
+
+	// the trash fits in keep bytes with the other records
+	assert.NilError(t, tc.cm.Prune(tc.ctx, nil, client.PruneInfo{All: true, KeepBytes: 1 << 30}))
+	assert.Check(t, is.DeepEqual(tc.trashed(t), []string{trashedID}))
+
+	// the trash is swept before the other records are pruned, which
+	// bypass the trash
+	assert.NilError(t, tc.cm.Prune(tc.ctx, nil, client.PruneInfo{All: true, KeepBytes: 1}))
+	assert.Check(t, is.Len(tc.trashed(t), 0))
+	_, err := tc.cm.Get(tc.ctx, liveID, nil)
+	assert.Check(t, err != nil)
+}
+
+func TestCacheMergeResults(t *testing.T) {
+	var observed int
+	tc := newTestCache(t, cache.ManagerOpt{
+		MergeObservers: map[string]snapshot.ChangeObserver{
+			"count": func(ctx context.Context, c *snapshot.MergeChange) error {
+				observed++
+				return nil
+			},
+		},
+	})
+
+	a := tc.newRef(t, nil, map[string][]byte{"a": []byte("a")})
+	b := tc.newRef(t, nil, map[string][]byte{"b": []byte("b")})
+	merge := func(opts ...cache.RefOption) cache.ImmutableRef {
+		t.Helper()
+		ref, err := tc.cm.Merge(tc.ctx, []cache.ImmutableRef{a, b}, nil, opts...)
+		assert.NilError(t, err)
+		tc.mount(t, ref)
+		return ref
+	}
+
+	// an observed merge doesn't reuse the result of an unobserved one
+	plain := merge()
+	observedRef := merge(cache.WithMergeObserver("count"))
+	assert.Check(t, is.Equal(observed, 2))
+	assert.Check(t, is.Equal(tc.mergeResults(t), 2))
+
+	// a merge with equal inputs and options reuses the result
+	reused := merge(cache.WithMergeObserver("count"))
+	assert.Check(t, is.Equal(observed, 2))
+	assert.Check(t, is.Equal(tc.mergeResults(t), 2))
+
+	// the result is deleted once no record uses its snapshot anymore
+	for _, ref := range []cache.ImmutableRef{plain, observedRef, a, b} {
+		assert.NilError(t, ref.Release(tc.ctx))
+	}
+	assert.NilError(t, tc.cm.Prune(tc.ctx, nil, client.PruneInfo{All: true}))
+	assert.Check(t, is.Equal(tc.mergeResults(t), 1))
+	assert.NilError(t, reused.Release(tc.ctx))
+	assert.NilError(t, tc.cm.Prune(tc.ctx, nil, client.PruneInfo{All: true}))
+	assert.Check(t, is.Equal(tc.mergeResults(t), 0))
+}
+
+func TestCacheDeterministicMerge(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+	ctx, done, err := leaseutil.WithLease(tc.ctx, tc.lm, leaseutil.MakeTemporary)
+	assert.NilError(t, err)
+	defer done(tc.ctx)
+
+	base := tc.newRef(t, nil, map[string][]byte{"d/base": []byte("base")})
+	defer base.Release(tc.ctx)
+	x := tc.newRef(t, base, map[string][]byte{"d/x": []byte("x")})
+	defer x.Release(tc.ctx)
+	y := tc.newRef(t, nil, map[string][]byte{"y": []byte("y"), "e/y": []byte("y")})
+	defer y.Release(tc.ctx)
+	// the diff only holds d/x, so merging it creates d as a parent dir
+	dx, err := tc.cm.Diff(ctx, base, x, nil)
+	assert.NilError(t, err)
+	defer dx.Release(tc.ctx)
+
+	// remerge returns the diff id of the layer with the content of the
+	// deterministic merge of y and dx on top of y, after which the merge is
+	// deleted so that the next call recomputes it
+	refCfg := config.RefConfig{Compression: compression.New(compression.Uncompressed)}
+	remerge := func() digest.Digest {
+		t.Helper()
+		merged, err := tc.cm.Merge(ctx, []cache.ImmutableRef{y, dx}, nil, cache.WithDeterministicMerge())
+		assert.NilError(t, err)
+		tc.mount(t, merged)
+		assert.Check(t, is.Equal(tc.mergeResults(t), 1))
+		layer, err := tc.cm.Diff(ctx, y, merged, nil)
+		assert.NilError(t, err)
+		remotes, err := layer.GetRemotes(ctx, true, refCfg, false, nil)
+		assert.NilError(t, err)
+		assert.Assert(t, is.Len(remotes, 1))
+		assert.Assert(t, is.Len(remotes[0].Descriptors, 1))
+		assert.NilError(t, layer.Release(tc.ctx))
+		assert.NilError(t, merged.Release(tc.ctx))
+		assert.NilError(t, tc.cm.Prune(tc.ctx, nil, client.PruneInfo{All: true}))
+		assert.Check(t, is.Equal(tc.mergeResults(t), 0))
+		return remotes[0].Descriptors[0].Digest
+	}
+
+	first := remerge()
+	assert.Check(t, is.Equal(remerge(), first))
+}
+
+func TestCacheGCDeferred(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+	for i := 0; i < 2; i++ {
+		ref := tc.newRef(t, nil, map[string][]byte{"foo": bytes.Repeat([]byte{byte(i)}, 1<<20)})
+		assert.NilError(t, ref.Release(tc.ctx))
+	}
+	usage := func() int {
+		t.Helper()
+		du, err := tc.cm.DiskUsage(tc.ctx, client.DiskUsageInfo{})
+		assert.NilError(t, err)
+		return len(du)
+	}
+
+	// the records a running job may reuse are kept until the deadline
+	release := tc.cm.RegisterJob("job")
+	assert.NilError(t, tc.cm.GC(tc.ctx, nil, client.PruneInfo{All: true, KeepBytes: 1}))
+	assert.Check(t, is.Equal(usage(), 2))
+
+	release()
+	assert.NilError(t, tc.cm.GC(tc.ctx, nil, client.PruneInfo{All: true, KeepBytes: 3 << 19}))
+	assert.Check(t, is.Equal(usage(), 1))
+}
+
+func TestCacheGetByBlobMediaTypes(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+	ctx, done, err := leaseutil.WithLease(tc.ctx, tc.lm, leaseutil.MakeTemporary)
+	assert.NilError(t, err)
+	defer done(tc.ctx)
+
+	for _, tt := range []struct {
+		mediaType string
+		err       string
+	}{
+		{mediaType: ocispecs.MediaTypeImageLayerGzip},
+		{mediaType: ocispecs.MediaTypeImageLayer + "+zstd"},
+		{mediaType: images.MediaTypeDockerSchema2Layer + ".zstd"},
+		{mediaType: "application/vnd.example.layer.v1.tar+lz4", err: "unsupported layer media type"},
+		{mediaType: ocispecs.MediaTypeImageConfig, err: "unsupported layer media type"},
+	} {
+		blob := []byte(tt.mediaType)
+		desc := ocispecs.Descriptor{
+			MediaType: tt.mediaType,
+			Digest:    digest.FromBytes(blob),
+			Size:      int64(len(blob)),
+			Annotations: map[string]string{
+				"containerd.io/uncompressed": digest.FromString("diff").String(),
+			},
+		}
+		assert.NilError(t, content.WriteBlob(ctx, tc.cs, desc.Digest.String(), bytes.NewReader(blob), desc))
+		ref, err := tc.cm.GetByBlob(ctx, desc, nil)
+		if tt.err != "" {
+			assert.Check(t, is.ErrorContains(err, tt.err), tt.mediaType)
+			continue
+		}
+		assert.NilError(t, err, tt.mediaType)
+		assert.NilError(t, ref.Release(tc.ctx))
+	}
+}
+
+func TestCacheUncompressedLayer(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+	ctx, done, err := leaseutil.WithLease(tc.ctx, tc.lm, leaseutil.MakeTemporary)
+	assert.NilError(t, err)
+	defer done(tc.ctx)
+
+	desc := tc.writeUncompressedLayer(ctx, t)
+
+	// the diffID of an unannotated uncompressed layer is its digest, and its
+	// blob is labeled with it
+	ref, err := tc.cm.GetByBlob(ctx, desc, nil)
+	assert.NilError(t, err)
+	defer ref.Release(tc.ctx)
+	info, err := tc.cs.Info(ctx, desc.Digest)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(info.Labels["buildkit.io/blob/mediatype"], ocispecs.MediaTypeImageLayer))
+	assert.Check(t, is.Equal(info.Labels["buildkit.io/blob/annotation.containerd.io/uncompressed"], desc.Digest.String()))
+
+	// the uncompressed remote is the blob itself, other compressions are
+	// variants converted from it
+	for _, tt := range []struct {
+		compression compression.Type
+		mediaType   string
+	}{
+		{compression: compression.Uncompressed, mediaType: ocispecs.MediaTypeImageLayer},
+		{compression: compression.Gzip, mediaType: ocispecs.MediaTypeImageLayerGzip},
+		{compression: compression.Uncompressed, mediaType: ocispecs.MediaTypeImageLayer},
+	} {
+		remotes, err := ref.GetRemotes(ctx, true, config.RefConfig{Compression: compression.New(tt.compression).SetForce(true)}, false, nil)
+		assert.NilError(t, err)
+		assert.Assert(t, is.Len(remotes, 1))
+		assert.Assert(t, is.Len(remotes[0].Descriptors, 1))
+		rdesc := remotes[0].Descriptors[0]
+		assert.Check(t, is.Equal(rdesc.MediaType, tt.mediaType), tt.compression)
+		assert.Check(t, is.Equal(rdesc.Digest == desc.Digest, tt.compression == compression.Uncompressed), tt.compression)
+		assert.Check(t, is.Equal(rdesc.Annotations["containerd.io/uncompressed"], desc.Digest.String()), tt.compression)
+	}
+}
+
+// TestCacheGetByManifestBlobless gets the layer chain of an image of the
+// layer store the way the builder pulls it, with descriptors that only have
+// the diffID of their layer.
+func TestCacheGetByManifestBlobless(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+	ctx, done, err := leaseutil.WithLease(tc.ctx, tc.lm, leaseutil.MakeTemporary)
+	assert.NilError(t, err)
+	defer done(tc.ctx)
+
+	var manifest ocispecs.Manifest
+	for _, diff := range []string{"a", "b", "c"} {
+		manifest.Layers = append(manifest.Layers, ocispecs.Descriptor{
+			Annotations: map[string]string{
+				"containerd.io/uncompressed": digest.FromString(diff).String(),
+			},
+		})
+	}
+	ref, err := tc.cm.GetByManifest(ctx, manifest)
+	assert.NilError(t, err)
+	defer ref.Release(tc.ctx)
+	chain := ref.LayerChain()
+	defer chain.Release(tc.ctx)
+	assert.Assert(t, is.Len(chain, 3))
+
+	// the records of the chain are reused, by manifest and by blob
+	again, err := tc.cm.GetByManifest(ctx, manifest)
+	assert.NilError(t, err)
+	defer again.Release(tc.ctx)
+	assert.Check(t, is.Equal(again.ID(), ref.ID()))
+	var parent cache.ImmutableRef
+	for i, desc := range manifest.Layers {
+		layer, err := tc.cm.GetByBlob(ctx, desc, parent)
+		if parent != nil {
+			parent.Release(tc.ctx)
+		}
+		assert.NilError(t, err)
+		assert.Check(t, is.Equal(layer.ID(), chain[i].ID()), i)
+		parent = layer
+	}
+	parent.Release(tc.ctx)
+}
+
+func TestCachePrefetchCompressionVariants(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+	ctx, done, err := leaseutil.WithLease(tc.ctx, tc.lm, leaseutil.MakeTemporary)
+	assert.NilError(t, err)
+	defer done(tc.ctx)
+
+	// an imported cache providing a gzip blob of the same layer lists it
+	desc := tc.writeUncompressedLayer(ctx, t)
+	desc.Annotations = map[string]string{cache.CompressionVariantsAnnotation: "gzip"}
+	ref, err := tc.cm.GetByBlob(ctx, desc, nil, cache.CompressionVariantPrefetchFor(desc))
+	assert.NilError(t, err)
+	defer ref.Release(tc.ctx)
+
+	// the gzip variant is converted in the background and linked to the blob
+	hasVariant := func() bool {
+		info, err := tc.cs.Info(ctx, desc.Digest)
+		assert.NilError(t, err)
+		for k := range info.Labels {
+			if strings.HasPrefix(k, "containerd.io/gc.ref.content.blob-") {
+				return true
+			}
+		}
+		return false
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for !hasVariant() {
+		assert.Assert(t, time.Now().Before(deadline), "compression variant was not prefetched")
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestCachePlacement(t *testing.T) {
+	scratch := newTestSnapshotter(t)
+	_, err := cache.NewManager(cache.ManagerOpt{
+		StorageClasses: map[string]cache.StorageClass{"scratch": {Placement: "tmpfs"}},
+	})
+	assert.Check(t, is.ErrorContains(err, `storage class "scratch" uses unknown snapshot placement "tmpfs"`))
+
+	tc := newTestCache(t, cache.ManagerOpt{
+		PlacementSnapshotters: map[string]snapshot.Snapshotter{"tmpfs": scratch.sn},
+	})
+
+	// placed refs can be mounted, but not committed
+	active, err := tc.cm.New(tc.ctx, nil, nil, cache.WithPlacement("tmpfs"))
+	assert.NilError(t, err)
+	defer active.Release(tc.ctx)
+	mntable, err := active.Mount(tc.ctx, false, nil)
+	assert.NilError(t, err)
+	_, release, err := mntable.Mount()
+	assert.NilError(t, err)
+	assert.NilError(t, release())
+	_, err = active.Commit(tc.ctx)
+	assert.Check(t, is.ErrorContains(err, `snapshot placement "tmpfs" is scratch space`))
+
+	// nor have a parent
+	parent := tc.newRef(t, nil, map[string][]byte{"foo": []byte("foo")})
+	defer parent.Release(tc.ctx)
+	_, err = tc.cm.New(tc.ctx, parent, nil, cache.WithPlacement("tmpfs"))
+	assert.Check(t, is.ErrorContains(err, `snapshot placement "tmpfs" is scratch space`))
+}
+
+func TestCacheDiffReusesLayerBlob(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+	ctx, done, err := leaseutil.WithLease(tc.ctx, tc.lm, leaseutil.MakeTemporary)
+	assert.NilError(t, err)
+	defer done(tc.ctx)
+
+	p := tc.newRef(t, nil, map[string][]byte{"p": []byte("p")})
+	defer p.Release(tc.ctx)
+	q := tc.newRef(t, nil, map[string][]byte{"q": []byte("q")})
+	defer q.Release(tc.ctx)
+	pq, err := tc.cm.Merge(tc.ctx, []cache.ImmutableRef{p, q}, nil)
+	assert.NilError(t, err)
+	defer pq.Release(tc.ctx)
+	qp, err := tc.cm.Merge(tc.ctx, []cache.ImmutableRef{q, p}, nil)
+	assert.NilError(t, err)
+	defer qp.Release(tc.ctx)
+	x := tc.newRef(t, pq, map[string][]byte{"x": []byte("x")})
+	defer x.Release(tc.ctx)
+
+	refCfg := config.RefConfig{Compression: compression.New(compression.Gzip)}
+	remotes, err := x.GetRemotes(ctx, true, refCfg, false, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(remotes, 1))
+	assert.Assert(t, is.Len(remotes[0].Descriptors, 3))
+	layer := remotes[0].Descriptors[2]
+
+	// qp isn't an ancestor of x, so the diff is computed, but it has the
+	// content of the layer of x, which has a parent, so its blob is reused
+	// rather than the one compressed with a different level
+	diff, err := tc.cm.Diff(ctx, qp, x, nil)
+	assert.NilError(t, err)
+	defer diff.Release(tc.ctx)
+	refCfg.Compression = refCfg.Compression.SetLevel(9)
+	remotes, err = diff.GetRemotes(ctx, true, refCfg, false, nil)
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(remotes, 1))
+	assert.Assert(t, is.Len(remotes[0].Descriptors, 1))
+	assert.Check(t, is.Equal(remotes[0].Descriptors[0].Digest, layer.Digest))
+
+	// the blob is leased by the diff, not only by the layer it was reused from
+	resources, err := tc.lm.ListResources(tc.ctx, leases.Lease{ID: diff.ID()})
+	assert.NilError(t, err)
+	assert.Check(t, is.Contains(resources, leases.Resource{ID: layer.Digest.String(), Type: "content"}))
+}
+
+func TestCacheDiffFilter(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+	ctx, done, err := leaseutil.WithLease(tc.ctx, tc.lm, leaseutil.MakeTemporary)
+	assert.NilError(t, err)
+	defer done(tc.ctx)
+
+	lower := tc.newRef(t, nil, map[string][]byte{"x": []byte("x")})
+	defer lower.Release(tc.ctx)
+	upper := tc.newRef(t, lower, map[string][]byte{"a": []byte("a"), "b": []byte("b"), "c": []byte("c")})
+	defer upper.Release(tc.ctx)
+
+	_, err = tc.cm.Diff(ctx, lower, upper, nil, cache.WithDiffFilter([]string{"["}, nil))
+	assert.Check(t, is.ErrorContains(err, "invalid include patterns"))
+
+	// upper is a single layer on top of lower, but the filtered diff holds
+	// only some of its changes instead of reusing it
+	diff, err := tc.cm.Diff(ctx, lower, upper, nil, cache.WithDiffFilter([]string{"a", "b"}, []string{"b"}))
+	assert.NilError(t, err)
+	defer diff.Release(tc.ctx)
+	mntable, err := diff.Mount(ctx, true, nil)
+	assert.NilError(t, err)
+	mounts, release, err := mntable.Mount()
+	assert.NilError(t, err)
+	defer release()
+	assert.NilError(t, mount.WithTempMount(ctx, mounts, func(root string) error {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		assert.Check(t, is.DeepEqual(names, []string{"a"}))
+		return nil
+	}))
+
+	_, err = diff.GetRemotes(ctx, true, config.RefConfig{Compression: compression.New(compression.Gzip)}, false, nil)
+	assert.Check(t, is.ErrorContains(err, "cannot create blob of filtered diff"))
+}
+
+func TestCacheUpperDir(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{UpperDirAccess: true})
+
+	parent := tc.newRef(t, nil, map[string][]byte{"foo": []byte("foo")})
+	defer parent.Release(tc.ctx)
+	active, err := tc.cm.New(tc.ctx, parent, nil)
+	assert.NilError(t, err)
+
+	// files written directly to the upperdir are seen by mounts of the ref
+	u, err := cache.UpperDirOf(tc.ctx, active)
+	assert.NilError(t, err)
+	assert.Check(t, u.Work != "")
+	assert.NilError(t, os.WriteFile(filepath.Join(u.Upper, "bar"), []byte("bar"), 0644))
+	_, err = cache.UpperDirOf(tc.ctx, active)
+	assert.Check(t, is.ErrorIs(err, cache.ErrLocked))
+	_, err = active.Commit(tc.ctx)
+	assert.Check(t, is.ErrorIs(err, cache.ErrLocked))
+	assert.NilError(t, u.Release(tc.ctx))
+
+	mntable, err := active.Mount(tc.ctx, true, nil)
+	assert.NilError(t, err)
+	mounts, release, err := mntable.Mount()
+	assert.NilError(t, err)
+	assert.NilError(t, mount.WithTempMount(tc.ctx, mounts, func(root string) error {
+		for _, name := range []string{"foo", "bar"} {
+			dt, err := os.ReadFile(filepath.Join(root, name))
+			assert.Check(t, err)
+			assert.Check(t, is.Equal(string(dt), name))
+		}
+		return nil
+	}))
+	assert.NilError(t, release())
+
+	// the upperdir keeps the record after the ref is released
+	u, err = cache.UpperDirOf(tc.ctx, active)
+	assert.NilError(t, err)
+	assert.NilError(t, active.Release(tc.ctx))
+	_, err = os.Stat(filepath.Join(u.Upper, "bar"))
+	assert.Check(t, err)
+	assert.NilError(t, u.Release(tc.ctx))
+	_, err = os.Stat(u.Upper)
+	assert.Check(t, is.ErrorIs(err, os.ErrNotExist))
+
+	// parentless refs of the graph driver are bind mounts of a directory that
+	// isn't known to be an upperdir
+	scratch, err := tc.cm.New(tc.ctx, nil, nil)
+	assert.NilError(t, err)
+	defer scratch.Release(tc.ctx)
+	_, err = cache.UpperDirOf(tc.ctx, scratch)
+	assert.Check(t, is.ErrorIs(err, cache.ErrNotOverlay))
+}
+
+func TestCacheCompressionHistory(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+	policy := &compression.Policy{History: remotecache.NewCompressionHistory(tc.md)}
+
+	// without history, nor a default, the compression is gzip
+	const target = "docker.io/library/alpine"
+	assert.Check(t, is.Equal(policy.Select(tc.ctx, target), compression.Gzip))
+
+	assert.NilError(t, policy.Record(tc.ctx, target, compression.EStargz, false))
+	assert.NilError(t, policy.Record(tc.ctx, target, compression.Zstd, true))
+	assert.Check(t, is.Equal(policy.Select(tc.ctx, target), compression.Zstd))
+	assert.Check(t, is.Equal(policy.Select(tc.ctx, "docker.io/library/busybox"), compression.Gzip))
+
+	// the history stores compressions by name
+	var dt []byte
+	assert.NilError(t, tc.md.DB().View(func(tx *bolt.Tx) error {
+		dt = append(dt, tx.Bucket([]byte("_compression_history")).Get([]byte(target))...)
+		return nil
+	}))
+	assert.Check(t, is.Equal(string(dt), `{"accepted":["zstd"],"rejected":["estargz"],"last":"zstd"}`))
+
+	// an explicit uncompressed default is kept for unknown targets
+	uncompressed := compression.Uncompressed
+	policy.Default = &uncompressed
+	assert.Check(t, is.Equal(policy.Select(tc.ctx, "docker.io/library/busybox"), compression.Uncompressed))
+}
+
+func TestCacheDiskUsageDetail(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+	ctx, done, err := leaseutil.WithLease(tc.ctx, tc.lm, leaseutil.MakeTemporary)
+	assert.NilError(t, err)
+	defer done(tc.ctx)
+
+	base := tc.newRef(t, nil, map[string][]byte{"foo": []byte("foo")})
+	defer base.Release(tc.ctx)
+	top := tc.newRef(t, base, map[string][]byte{"bar": []byte("bar")})
+	defer top.Release(tc.ctx)
+
+	// the top layer has a gzip blob and a zstd variant of it
+	var blobs []ocispecs.Descriptor
+	for _, c := range []compression.Type{compression.Gzip, compression.Zstd} {
+		remotes, err := top.GetRemotes(ctx, true, config.RefConfig{Compression: compression.New(c).SetForce(true)}, false, nil)
+		assert.NilError(t, err)
+		blobs = append(blobs, remotes[0].Descriptors[1])
+	}
+
+	du, err := tc.cm.DiskUsageDetail(tc.ctx, top.ID())
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(du, 2))
+	assert.Check(t, is.Equal(du[0].ID, base.ID()))
+	assert.Check(t, is.Equal(du[1].ID, top.ID()))
+	assert.Check(t, is.DeepEqual(du[1].Parents, []string{base.ID()}))
+	for _, l := range du {
+		assert.Check(t, l.Size > 0, l.ID)
+		assert.Check(t, l.Blob.Digest != "", l.ID)
+	}
+	assert.Check(t, is.Equal(du[1].Blob.Digest, blobs[0].Digest))
+	assert.Check(t, is.Equal(du[1].Blob.Size, blobs[0].Size))
+	assert.Assert(t, is.Len(du[1].Variants, 1))
+	assert.Check(t, is.Equal(du[1].Variants[0].Digest, blobs[1].Digest))
+	assert.Check(t, is.Equal(du[1].Variants[0].Size, blobs[1].Size))
+}
+
+func TestCacheAccessJournal(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{AccessJournalSize: 2})
+
+	ref := tc.newRef(t, nil, map[string][]byte{"foo": []byte("foo")})
+	defer ref.Release(tc.ctx)
+	for _, id := range []string{"session0", "session1"} {
+		_, err := ref.Mount(tc.ctx, true, session.NewGroup(id))
+		assert.NilError(t, err)
+	}
+	assert.NilError(t, cache.RecordAccess(ref, cache.AccessExport, "session2", "docker.io/library/foo:latest"))
+
+	journalOf := func(du []*client.UsageInfo) []client.AccessEntry {
+		for _, ui := range du {
+			if ui.ID == ref.ID() {
+				return ui.AccessJournal
+			}
+		}
+		t.Fatalf("no usage of %s", ref.ID())
+		return nil
+	}
+
+	// the journal is only included if requested
+	du, err := tc.cm.DiskUsage(tc.ctx, client.DiskUsageInfo{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(journalOf(du), 0))
+
+	// the oldest entries are rotated out
+	du, err = tc.cm.DiskUsage(tc.ctx, client.DiskUsageInfo{AccessJournal: true})
+	assert.NilError(t, err)
+	journal := journalOf(du)
+	assert.Assert(t, is.Len(journal, 2))
+	assert.Check(t, is.Equal(journal[0].Op, cache.AccessMount))
+	assert.Check(t, is.DeepEqual(journal[0].SessionIDs, []string{"session1"}))
+	assert.Check(t, is.Equal(journal[1].Op, cache.AccessExport))
+	assert.Check(t, is.DeepEqual(journal[1].SessionIDs, []string{"session2"}))
+	assert.Check(t, is.Equal(journal[1].Target, "docker.io/library/foo:latest"))
+	assert.Check(t, !journal[1].Time.Before(journal[0].Time))
+}
+
+func TestCachePruneExclusions(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+
+	for _, descr := range []string{"base-image alpine", "build step"} {
+		active, err := tc.cm.New(tc.ctx, nil, nil, cache.CachePolicyRetain, cache.WithDescription(descr))
+		assert.NilError(t, err)
+		ref, err := active.Commit(tc.ctx)
+		assert.NilError(t, err)
+		assert.NilError(t, ref.Release(tc.ctx))
+	}
+
+	assert.Check(t, is.ErrorContains(tc.cm.SetPruneExclusions(tc.ctx, []string{"size>>1"}), "failed to parse prune exclusions"))
+	exclusions := []string{"description~=base-image"}
+	assert.NilError(t, tc.cm.SetPruneExclusions(tc.ctx, exclusions))
+	got, err := tc.cm.PruneExclusions(tc.ctx)
+	assert.NilError(t, err)
+	assert.Check(t, is.DeepEqual(got, exclusions))
+
+	// records matching the exclusions are kept by any prune
+	assert.NilError(t, tc.cm.Prune(tc.ctx, nil, client.PruneInfo{All: true}, client.PruneInfo{All: true, KeepBytes: 1}))
+	du, err := tc.cm.DiskUsage(tc.ctx, client.DiskUsageInfo{})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(du, 1))
+	assert.Check(t, is.Equal(du[0].Description, "base-image alpine"))
+
+	// the exclusions are persisted as filters
+	var dt []byte
+	assert.NilError(t, tc.md.DB().View(func(tx *bolt.Tx) error {
+		dt = append(dt, tx.Bucket([]byte("_prune_exclusions")).Get([]byte("filters"))...)
+		return nil
+	}))
+	assert.Check(t, is.Equal(string(dt), `["description~=base-image"]`))
+
+	assert.NilError(t, tc.cm.SetPruneExclusions(tc.ctx, nil))
+	assert.NilError(t, tc.cm.Prune(tc.ctx, nil, client.PruneInfo{All: true}))
+	du, err = tc.cm.DiskUsage(tc.ctx, client.DiskUsageInfo{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(du, 0))
+}
+
+func TestCachePruneChain(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+
+	// a three-deep chain released from the bottom up, its intermediate
+	// records were used before its top
+	var chain []cache.ImmutableRef
+	var parent cache.ImmutableRef
+	for _, p := range []string{"a", "b", "c"} {
+		parent = tc.newRef(t, parent, map[string][]byte{p: []byte(p)})
+		chain = append(chain, parent)
+	}
+	for _, ref := range chain {
+		assert.NilError(t, ref.Release(tc.ctx))
+	}
+	kept := tc.newRef(t, nil, map[string][]byte{"d": []byte("d")})
+	assert.NilError(t, kept.Release(tc.ctx))
+
+	// the mutable records of the finalized refs are removed in the
+	// background
+	var du []*client.UsageInfo
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		var err error
+		du, err = tc.cm.DiskUsage(tc.ctx, client.DiskUsageInfo{})
+		assert.NilError(t, err)
+		if len(du) != 4 {
+			return poll.Continue("%d records", len(du))
+		}
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second))
+	var total, top int64
+	for _, ui := range du {
+		total += ui.Size
+		if ui.ID == chain[2].ID() {
+			top = ui.Size
+		}
+	}
+
+	// deleting the top of the chain is enough to get below the keep bytes,
+	// the parents only it holds go in the same prune rather than waiting
+	// for the next ones
+	assert.NilError(t, tc.cm.Prune(tc.ctx, nil, client.PruneInfo{All: true, KeepBytes: total - top + 1}))
+	du, err := tc.cm.DiskUsage(tc.ctx, client.DiskUsageInfo{})
+	assert.NilError(t, err)
+	assert.Assert(t, is.Len(du, 1))
+	assert.Check(t, is.Equal(du[0].ID, kept.ID()))
+}
+
+func TestCacheResidency(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{MaxResidentRecords: 2, ContextKeepPerKey: 1})
+
+	// context refs stay mutable and are never evicted
+	var contexts []string
+	for i := 0; i < 3; i++ {
+		active, err := tc.cm.New(tc.ctx, nil, nil, cache.CachePolicyRetain, cache.WithContextKey("client/context"))
+		assert.NilError(t, err)
+		ref, err := active.Commit(tc.ctx)
+		assert.NilError(t, err)
+		contexts = append(contexts, active.ID())
+		assert.NilError(t, ref.Release(tc.ctx))
+		// the records must not share their creation time
+		time.Sleep(10 * time.Millisecond)
+	}
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ref := tc.newRef(t, nil, map[string][]byte{"foo": []byte("foo")})
+		ids = append(ids, ref.ID())
+		assert.NilError(t, ref.Release(tc.ctx))
+	}
+	// the mutable records of the finalized refs are removed in the
+	// background
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if stats := tc.cm.ResidencyStats(); stats.Resident != 6 || stats.Evicted != 3 {
+			return poll.Continue("%d records resident, %d evicted", stats.Resident, stats.Evicted)
+		}
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second))
+
+	// evicted records are loaded again when they are needed, and evicted
+	// again once they are released
+	ref, err := tc.cm.Get(tc.ctx, ids[0], nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(tc.cm.ResidencyStats().Evicted, 2))
+	tc.mount(t, ref)
+	assert.NilError(t, ref.Release(tc.ctx))
+	du, err := tc.cm.DiskUsage(tc.ctx, client.DiskUsageInfo{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(du, 6))
+	stats := tc.cm.ResidencyStats()
+	assert.Check(t, is.Equal(stats.Resident, 6))
+	assert.Check(t, is.Equal(stats.Evicted, 3))
+
+	// only the most recent context ref is kept by prune
+	assert.NilError(t, tc.cm.Prune(tc.ctx, nil))
+	du, err = tc.cm.DiskUsage(tc.ctx, client.DiskUsageInfo{})
+	assert.NilError(t, err)
+	var left []string
+	for _, ui := range du {
+		left = append(left, ui.ID)
+	}
+	assert.Check(t, is.DeepEqual(left, append(ids, contexts[2]), cmpopts.SortSlices(func(a, b string) bool { return a < b })))
+}
+
+func TestCacheDematerialize(t *testing.T) {
+	applier := &testApplier{}
+	tc := newTestCache(t, cache.ManagerOpt{
+		Applier: applier,
+		DiskPressure: cache.DiskPressureOpt{
+			Interval:       10 * time.Millisecond,
+			Roots:          []string{t.TempDir()},
+			LowFreePercent: 100,
+			Dematerialize:  true,
+		},
+	})
+	applier.cs = tc.cs
+	events := make(chan cache.DiskPressureEvent, 1)
+	unregister := tc.cm.RegisterDiskPressureCallback(func(ctx context.Context, ev cache.DiskPressureEvent) {
+		if ev.Dematerialized > 0 {
+			select {
+			case events <- ev:
+			default:
+			}
+		}
+	})
+	defer unregister()
+
+	ref := tc.newRef(t, nil, map[string][]byte{"foo": []byte("foo")})
+	id := ref.ID()
+	_, err := ref.GetRemotes(tc.ctx, true, config.RefConfig{Compression: compression.New(compression.Uncompressed)}, false, nil)
+	assert.NilError(t, err)
+	// keep the record from the emergency prunes of the watcher, which is
+	// always under pressure
+	assert.NilError(t, tc.cm.SetPruneExclusions(tc.ctx, []string{"id==" + id}))
+	assert.NilError(t, ref.Release(tc.ctx))
+
+	// the watcher dematerializes the idle record before pruning
+	select {
+	case ev := <-events:
+		assert.Check(t, is.Equal(ev.Dematerialized, 1))
+	case <-time.After(10 * time.Second):
+		t.Fatal("record not dematerialized under disk pressure")
+	}
+
+	// the record is extracted again from its blob on next use
+	ref, err = tc.cm.Get(tc.ctx, id, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(tc.readFile(t, ref, "foo"), "foo"))
+	assert.NilError(t, ref.Release(tc.ctx))
+}
+
+func TestCacheDematerializeWithoutApplier(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+
+	ref := tc.newRef(t, nil, map[string][]byte{"foo": []byte("foo")})
+	id := ref.ID()
+	_, err := ref.GetRemotes(tc.ctx, true, config.RefConfig{Compression: compression.New(compression.Uncompressed)}, false, nil)
+	assert.NilError(t, err)
+	assert.NilError(t, ref.Release(tc.ctx))
+
+	// the builder can't extract blobs, so its records are kept
+	assert.NilError(t, tc.cm.Dematerialize(tc.ctx, id))
+	ref, err = tc.cm.Get(tc.ctx, id, nil)
+	assert.NilError(t, err)
+	assert.Check(t, is.Equal(tc.readFile(t, ref, "foo"), "foo"))
+	assert.NilError(t, ref.Release(tc.ctx))
+}
+
+func TestCacheScrub(t *testing.T) {
+	ts := newTestSnapshotter(t)
+	cs := containerdsnapshot.NewContentStore(ts.mdb.ContentStore(), "buildkit")
+	mdPath := filepath.Join(ts.root, "metadata_v2.db")
+	newManager := func(scrub cache.ScrubOpt) cache.Manager {
+		md, err := metadata.NewStore(mdPath)
+		assert.NilError(t, err)
+		cm, err := cache.NewManager(cache.ManagerOpt{
+			Snapshotter:    ts.sn,
+			MetadataStore:  md,
+			LeaseManager:   ts.lm,
+			ContentStore:   cs,
+			GarbageCollect: ts.mdb.GarbageCollect,
+			Scrub:          scrub,
+		})
+		assert.NilError(t, err)
+		return cm
+	}
+	ctx := context.Background()
+
+	cm := newManager(cache.ScrubOpt{})
+	tc := &testCache{ctx: ctx, cs: cs}
+	desc := tc.writeUncompressedLayer(ctx, t)
+	ref, err := cm.GetByBlob(ctx, desc, nil)
+	assert.NilError(t, err)
+	id := ref.ID()
+	assert.NilError(t, ref.Release(ctx))
+	assert.NilError(t, cm.Close())
+
+	p := filepath.Join(ts.root, "content", "blobs", desc.Digest.Algorithm().String(), desc.Digest.Hex())
+	assert.NilError(t, os.WriteFile(p, bytes.Repeat([]byte{0}, int(desc.Size)), 0644))
+
+	// the scrubber checks the first blob as soon as the manager starts
+	corrupted := make(chan cache.CorruptedBlob, 1)
+	cm = newManager(cache.ScrubOpt{
+		Fraction:   1,
+		AutoDelete: true,
+		OnCorrupted: func(ctx context.Context, b cache.CorruptedBlob) {
+			corrupted <- b
+		},
+	})
+	defer cm.Close()
+	select {
+	case b := <-corrupted:
+		assert.Check(t, is.Equal(b.Digest, desc.Digest))
+		assert.Check(t, b.Actual != desc.Digest)
+		assert.Check(t, is.DeepEqual(b.Records, []string{id}))
+		assert.Check(t, b.Deleted)
+	case <-time.After(10 * time.Second):
+		t.Fatal("corrupted blob not found")
+	}
+	_, err = cs.Info(ctx, desc.Digest)
+	assert.Check(t, errdefs.IsNotFound(err))
+}
+
+func TestCacheBackfillBlobIndexes(t *testing.T) {
+	ts := newTestSnapshotter(t)
+	cs := containerdsnapshot.NewContentStore(ts.mdb.ContentStore(), "buildkit")
+	mdPath := filepath.Join(ts.root, "metadata_v2.db")
+	newManager := func() (cache.Manager, *metadata.Store) {
+		md, err := metadata.NewStore(mdPath)
+		assert.NilError(t, err)
+		cm, err := cache.NewManager(cache.ManagerOpt{
+			Snapshotter:    ts.sn,
+			MetadataStore:  md,
+			LeaseManager:   ts.lm,
+			ContentStore:   cs,
+			GarbageCollect: ts.mdb.GarbageCollect,
+		})
+		assert.NilError(t, err)
+		return cm, md
+	}
+	ctx := context.Background()
+
+	cm, _ := newManager()
+	tc := &testCache{ctx: ctx, cs: cs}
+	desc := tc.writeUncompressedLayer(ctx, t)
+	ref, err := cm.GetByBlob(ctx, desc, nil)
+	assert.NilError(t, err)
+	id := ref.ID()
+	assert.NilError(t, ref.Release(ctx))
+	assert.NilError(t, cm.Close())
+
+	// make the record look like one written before its diffID and blob
+	// were indexed
+	indexes := []string{"diffid:" + desc.Digest.String(), "blob:" + desc.Digest.String()}
+	md, err := metadata.NewStore(mdPath)
+	assert.NilError(t, err)
+	si, ok := md.Get(id)
+	assert.Assert(t, ok)
+	assert.NilError(t, si.Update(func(b *bolt.Bucket) error {
+		for i, key := range []string{"cache.diffID", "cache.blob"} {
+			v := si.Get(key)
+			assert.Assert(t, v != nil)
+			if err := si.SetValue(b, key, &metadata.Value{Value: v.Value}); err != nil {
+				return err
+			}
+			if err := si.ClearIndex(b.Tx(), indexes[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	for _, index := range indexes {
+		sis, err := md.Search(index)
+		assert.NilError(t, err)
+		assert.Assert(t, is.Len(sis, 0))
+	}
+	assert.NilError(t, md.Close())
+
+	cm, md = newManager()
+	defer cm.Close()
+	for _, index := range indexes {
+		sis, err := md.Search(index)
+		assert.NilError(t, err)
+		assert.Assert(t, is.Len(sis, 1), index)
+		assert.Check(t, is.Equal(sis[0].ID(), id))
+	}
+}
@@ -0,0 +1,88 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/exporter/cachebundle"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+// writeBundle writes a cache bundle with a single layer holding the file foo
+// to dir, returning the descriptor of the layer blob.
+func writeBundle(t *testing.T, dir string) ocispecs.Descriptor {
+	t.Helper()
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Name: "foo", Mode: 0644, Size: 3, Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte("foo"))
+	assert.NilError(t, err)
+	assert.NilError(t, tw.Close())
+	diffID := digest.FromBytes(tarBuf.Bytes())
+
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	_, err = gw.Write(tarBuf.Bytes())
+	assert.NilError(t, err)
+	assert.NilError(t, gw.Close())
+	desc := ocispecs.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2LayerGzip,
+		Digest:    digest.FromBytes(gzBuf.Bytes()),
+		Size:      int64(gzBuf.Len()),
+	}
+
+	store, err := local.NewStore(dir)
+	assert.NilError(t, err)
+	assert.NilError(t, content.WriteBlob(context.Background(), store, desc.Digest.String(), bytes.NewReader(gzBuf.Bytes()), desc))
+
+	dt, err := json.Marshal(cachebundle.Index{
+		MediaType: cachebundle.MediaType,
+		Chains: map[string][]cachebundle.Layer{
+			"": {{
+				Descriptor:  desc,
+				DiffID:      diffID,
+				ChainID:     diffID,
+				BlobChainID: desc.Digest,
+			}},
+		},
+	})
+	assert.NilError(t, err)
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "index.json"), dt, 0644))
+	return desc
+}
+
+func TestCacheBundleImport(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+	dir := t.TempDir()
+	desc := writeBundle(t, dir)
+
+	assert.NilError(t, cachebundle.Import(tc.ctx, tc.cm, tc.cs, tc.lm, dir))
+
+	// the blob is held by the imported record, not by the lease it was
+	// ingested under
+	ls, err := tc.lm.List(tc.ctx)
+	assert.NilError(t, err)
+	for _, l := range ls {
+		assert.Check(t, l.Labels["buildkit/lease.op"] != "cachebundle-import", "import lease %s not deleted", l.ID)
+	}
+	_, err = tc.cs.Info(tc.ctx, desc.Digest)
+	assert.NilError(t, err)
+
+	refs, err := tc.cm.DiskUsage(tc.ctx, client.DiskUsageInfo{})
+	assert.NilError(t, err)
+	assert.Check(t, is.Len(refs, 1))
+}
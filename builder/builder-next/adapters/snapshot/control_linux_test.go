@@ -0,0 +1,101 @@
+package snapshot
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/control"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/solver"
+	"github.com/moby/buildkit/worker"
+	"google.golang.org/grpc"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+// cacheWorker is a worker with only a cache manager, for the control API
+// calls that don't solve anything.
+type cacheWorker struct {
+	worker.Worker
+	cm cache.Manager
+}
+
+func (w *cacheWorker) ID() string                   { return "cache" }
+func (w *cacheWorker) Labels() map[string]string    { return nil }
+func (w *cacheWorker) GCPolicy() []client.PruneInfo { return nil }
+func (w *cacheWorker) CacheManager() cache.Manager  { return w.cm }
+
+// newCacheControlClient returns a client of a controller serving the cache
+// of tc over a unix socket.
+func newCacheControlClient(t *testing.T, tc *testCache) *client.Client {
+	wc := &worker.Controller{}
+	assert.NilError(t, wc.Add(&cacheWorker{cm: tc.cm}))
+	sm, err := session.NewManager()
+	assert.NilError(t, err)
+	ctrl, err := control.NewController(control.Opt{
+		SessionManager:   sm,
+		WorkerController: wc,
+		CacheKeyStorage:  solver.NewInMemoryCacheStorage(),
+	})
+	assert.NilError(t, err)
+
+	srv := grpc.NewServer()
+	assert.NilError(t, ctrl.Register(srv))
+	sock := filepath.Join(t.TempDir(), "buildkitd.sock")
+	l, err := net.Listen("unix", sock)
+	assert.NilError(t, err)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+
+	c, err := client.New(tc.ctx, "unix://"+sock)
+	assert.NilError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCacheControl(t *testing.T) {
+	tc := newTestCache(t, cache.ManagerOpt{})
+	c := newCacheControlClient(t, tc)
+
+	a := tc.newRef(t, nil, map[string][]byte{"a": []byte("a")})
+	defer a.Release(tc.ctx)
+	b := tc.newRef(t, nil, map[string][]byte{"b": []byte("b")})
+	defer b.Release(tc.ctx)
+	get := func(id string) cache.ImmutableRef {
+		t.Helper()
+		ref, err := tc.cm.Get(tc.ctx, id, nil)
+		assert.NilError(t, err)
+		t.Cleanup(func() { ref.Release(context.TODO()) })
+		return ref
+	}
+
+	mergedID, err := c.CacheMerge(tc.ctx, []string{a.ID(), b.ID()}, "merged")
+	assert.NilError(t, err)
+	merged := get(mergedID)
+	assert.Check(t, is.Equal(merged.GetDescription(), "merged"))
+	assert.Check(t, is.Equal(tc.readFile(t, merged, "a"), "a"))
+	assert.Check(t, is.Equal(tc.readFile(t, merged, "b"), "b"))
+
+	diffID, err := c.CacheDiff(tc.ctx, a.ID(), mergedID, "diff")
+	assert.NilError(t, err)
+	diff := get(diffID)
+	assert.Check(t, is.Equal(diff.GetDescription(), "diff"))
+	assert.Check(t, is.Equal(tc.readFile(t, diff, "b"), "b"))
+
+	squashedID, err := c.CacheSquash(tc.ctx, mergedID, "squashed")
+	assert.NilError(t, err)
+	squashed := get(squashedID)
+	assert.Check(t, is.Equal(squashed.GetDescription(), "squashed"))
+	assert.Check(t, is.Len(squashed.LayerChain(), 1))
+	assert.Check(t, is.Equal(tc.readFile(t, squashed, "a"), "a"))
+	assert.Check(t, is.Equal(tc.readFile(t, squashed, "b"), "b"))
+
+	_, err = c.CacheMerge(tc.ctx, nil, "")
+	assert.Check(t, is.ErrorContains(err, "no records to merge"))
+	_, err = c.CacheSquash(tc.ctx, "missing", "")
+	assert.Check(t, is.ErrorContains(err, "failed to get record missing"))
+}
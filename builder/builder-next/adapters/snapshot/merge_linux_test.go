@@ -0,0 +1,446 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/moby/buildkit/snapshot"
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+)
+
+type mergeTest struct {
+	ctx context.Context
+	sn  snapshot.MergeSnapshotter
+	lm  leases.Manager
+}
+
+// newMergeTest returns the merge snapshotter of an overlay2 backed
+// snapshotter, as created by the builder.
+func newMergeTest(t testing.TB) *mergeTest {
+	ts := newTestSnapshotter(t)
+	ctx := namespaces.WithNamespace(context.Background(), "buildkit")
+	return &mergeTest{
+		ctx: ctx,
+		sn:  snapshot.NewMergeSnapshotter(ctx, ts.sn, ts.lm),
+		lm:  ts.lm,
+	}
+}
+
+// commit creates the committed snapshot key on top of parent with the
+// changes made by apply to its mounted root.
+func (mt *mergeTest) commit(t testing.TB, key, parent string, apply func(root string) error) {
+	t.Helper()
+	active := key + "-active"
+	assert.NilError(t, mt.sn.Prepare(mt.ctx, active, parent))
+	mt.withMount(t, active, apply)
+	assert.NilError(t, mt.sn.Commit(mt.ctx, key, active))
+}
+
+func (mt *mergeTest) withMount(t testing.TB, key string, f func(root string) error) {
+	t.Helper()
+	mntable, err := mt.sn.Mounts(mt.ctx, key)
+	assert.NilError(t, err)
+	mounts, release, err := mntable.Mount()
+	assert.NilError(t, err)
+	defer release()
+	assert.NilError(t, mount.WithTempMount(mt.ctx, mounts, f))
+}
+
+// contents returns the regular files of the committed snapshot key with
+// their contents, keyed by path.
+func (mt *mergeTest) contents(t *testing.T, key string) map[string]string {
+	t.Helper()
+	mntable, err := mt.sn.View(mt.ctx, key+"-view", key)
+	assert.NilError(t, err)
+	mounts, release, err := mntable.Mount()
+	assert.NilError(t, err)
+	defer release()
+
+	files := map[string]string{}
+	assert.NilError(t, mount.WithTempMount(mt.ctx, mounts, func(root string) error {
+		return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.Mode().IsRegular() {
+				return err
+			}
+			dt, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(root, path)
+			files[rel] = string(dt)
+			return nil
+		})
+	}))
+	return files
+}
+
+// stacked reports whether the merged snapshot key was stacked, returning
+// the number of snapshots it holds.
+func (mt *mergeTest) stacked(t *testing.T, key string) (int, bool) {
+	t.Helper()
+	ls, err := mt.lm.List(mt.ctx, "id==merge-stack-"+key)
+	assert.NilError(t, err)
+	if len(ls) == 0 {
+		return 0, false
+	}
+	rs, err := mt.lm.ListResources(mt.ctx, ls[0])
+	assert.NilError(t, err)
+	return len(rs), true
+}
+
+func writeFiles(files map[string]string) func(root string) error {
+	return func(root string) error {
+		for p, dt := range files {
+			if err := os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(root, p), []byte(dt), 0644); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func TestStackedMerge(t *testing.T) {
+	mt := newMergeTest(t)
+	mt.commit(t, "a", "", writeFiles(map[string]string{"a": "a", "dir/shared": "a"}))
+	mt.commit(t, "b", "", writeFiles(map[string]string{"b": "b", "dir/shared": "b"}))
+	mt.commit(t, "c", "", writeFiles(map[string]string{"c": "c"}))
+
+	assert.NilError(t, mt.sn.Merge(mt.ctx, "ab", []snapshot.Diff{{Upper: "a"}, {Upper: "b"}}, snapshot.WithStackedMerge()))
+	n, ok := mt.stacked(t, "ab")
+	assert.Check(t, ok)
+	assert.Check(t, is.Equal(n, 1))
+	assert.Check(t, is.DeepEqual(mt.contents(t, "ab"), map[string]string{
+		"a":          "a",
+		"b":          "b",
+		"dir/shared": "b",
+	}))
+
+	// stacking a stacked merge, whose parent is its base, holds the
+	// snapshots it stacks
+	assert.NilError(t, mt.sn.Merge(mt.ctx, "cb", []snapshot.Diff{{Upper: "c"}, {Lower: "a", Upper: "ab"}}, snapshot.WithStackedMerge()))
+	n, ok = mt.stacked(t, "cb")
+	assert.Check(t, ok)
+	assert.Check(t, is.Equal(n, 2))
+	assert.Check(t, is.DeepEqual(mt.contents(t, "cb"), map[string]string{
+		"b":          "b",
+		"c":          "c",
+		"dir/shared": "b",
+	}))
+}
+
+func TestStackedMergeFallback(t *testing.T) {
+	mt := newMergeTest(t)
+	mt.commit(t, "a", "", writeFiles(map[string]string{"a": "a", "dir/shared": "a"}))
+	mt.commit(t, "b", "", writeFiles(map[string]string{"b": "b"}))
+	mt.commit(t, "a-rm", "a", func(root string) error {
+		return os.Remove(filepath.Join(root, "dir/shared"))
+	})
+	filter, err := snapshot.NewChangeFilter(nil, []string{"b"})
+	assert.NilError(t, err)
+
+	for _, tc := range []struct {
+		name  string
+		diffs []snapshot.Diff
+		opts  []snapshot.MergeOpt
+		files map[string]string
+	}{
+		{
+			name:  "unrequested",
+			diffs: []snapshot.Diff{{Upper: "a"}, {Upper: "b"}},
+			files: map[string]string{"a": "a", "b": "b", "dir/shared": "a"},
+		},
+		{
+			name:  "deterministic",
+			diffs: []snapshot.Diff{{Upper: "a"}, {Upper: "b"}},
+			opts:  []snapshot.MergeOpt{snapshot.WithStackedMerge(), snapshot.WithDeterministicMerge()},
+			files: map[string]string{"a": "a", "b": "b", "dir/shared": "a"},
+		},
+		{
+			name:  "whiteout",
+			diffs: []snapshot.Diff{{Upper: "b"}, {Upper: "a"}, {Lower: "a", Upper: "a-rm"}},
+			opts:  []snapshot.MergeOpt{snapshot.WithStackedMerge()},
+			files: map[string]string{"a": "a", "b": "b"},
+		},
+		{
+			name:  "filtered",
+			diffs: []snapshot.Diff{{Upper: "a"}, {Upper: "b", Filter: filter}},
+			opts:  []snapshot.MergeOpt{snapshot.WithStackedMerge()},
+			files: map[string]string{"a": "a", "dir/shared": "a"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			key := "merge-" + tc.name
+			assert.NilError(t, mt.sn.Merge(mt.ctx, key, tc.diffs, tc.opts...))
+			_, ok := mt.stacked(t, key)
+			assert.Check(t, !ok)
+			assert.Check(t, is.DeepEqual(mt.contents(t, key), tc.files))
+		})
+	}
+}
+
+func TestStackedMergeBounded(t *testing.T) {
+	mt := newMergeTest(t)
+	var diffs []snapshot.Diff
+	for i := 0; i < 130; i++ {
+		key := fmt.Sprintf("l%d", i)
+		mt.commit(t, key, "", writeFiles(map[string]string{key: key}))
+		diffs = append(diffs, snapshot.Diff{Upper: key})
+	}
+
+	assert.NilError(t, mt.sn.Merge(mt.ctx, "few", diffs[:8], snapshot.WithStackedMerge()))
+	_, ok := mt.stacked(t, "few")
+	assert.Check(t, ok)
+
+	assert.NilError(t, mt.sn.Merge(mt.ctx, "many", diffs, snapshot.WithStackedMerge()))
+	_, ok = mt.stacked(t, "many")
+	assert.Check(t, !ok)
+	assert.Check(t, is.Len(mt.contents(t, "many"), len(diffs)))
+}
+
+func TestMergeObserver(t *testing.T) {
+	mt := newMergeTest(t)
+	mt.commit(t, "a", "", writeFiles(map[string]string{"a": "a"}))
+	mt.commit(t, "b", "", writeFiles(map[string]string{"b": "b"}))
+	mt.commit(t, "etc", "", writeFiles(map[string]string{"etc/passwd": "root"}))
+
+	// the observer sees the changes of the base input too, and keeps the
+	// merge from being stacked
+	var observed []string
+	obs := func(ctx context.Context, c *snapshot.MergeChange) error {
+		observed = append(observed, c.SubPath)
+		return nil
+	}
+	assert.NilError(t, mt.sn.Merge(mt.ctx, "ab", []snapshot.Diff{{Upper: "a"}, {Upper: "b"}},
+		snapshot.WithStackedMerge(), snapshot.WithChangeObserver(obs)))
+	assert.Check(t, is.DeepEqual(observed, []string{"/a", "/b"}))
+	_, ok := mt.stacked(t, "ab")
+	assert.Check(t, !ok)
+	assert.Check(t, is.DeepEqual(mt.contents(t, "ab"), map[string]string{"a": "a", "b": "b"}))
+
+	veto := func(ctx context.Context, c *snapshot.MergeChange) error {
+		if c.SubPath == "/etc" {
+			return errors.New("merges may not touch /etc")
+		}
+		return nil
+	}
+	err := mt.sn.Merge(mt.ctx, "etca", []snapshot.Diff{{Upper: "etc"}, {Upper: "a"}}, snapshot.WithChangeObserver(veto))
+	assert.Check(t, is.ErrorContains(err, "merges may not touch /etc"))
+}
+
+func TestMergeJournalCanceled(t *testing.T) {
+	mt := newMergeTest(t)
+	mt.commit(t, "a", "", writeFiles(map[string]string{"a": "a"}))
+	mt.commit(t, "b", "", writeFiles(map[string]string{"b": "b"}))
+	diffs := []snapshot.Diff{{Upper: "a"}, {Upper: "b"}}
+
+	journals := func() []string {
+		t.Helper()
+		ls, err := mt.lm.List(mt.ctx)
+		assert.NilError(t, err)
+		var ids []string
+		for _, l := range ls {
+			if strings.HasPrefix(l.ID, "merge-journal-") {
+				ids = append(ids, l.ID)
+			}
+		}
+		return ids
+	}
+
+	// a merge canceled by a shutdown keeps its journal to be resumed
+	ctx, cancel := context.WithCancel(mt.ctx)
+	err := mt.sn.Merge(ctx, "ab", diffs, snapshot.WithChangeObserver(func(ctx context.Context, c *snapshot.MergeChange) error {
+		cancel()
+		return ctx.Err()
+	}))
+	assert.Check(t, is.ErrorContains(err, "context canceled"))
+	assert.Check(t, is.DeepEqual(journals(), []string{"merge-journal-ab"}))
+
+	// a journal that wasn't kept for long isn't pruned
+	assert.NilError(t, mt.sn.PruneMergeJournals(mt.ctx))
+	assert.Check(t, is.DeepEqual(journals(), []string{"merge-journal-ab"}))
+
+	// the snapshotter doesn't persist the progress of the merge, so it
+	// starts over, and its journal is released once it's done
+	assert.NilError(t, mt.sn.Merge(mt.ctx, "ab", diffs))
+	assert.Check(t, is.Len(journals(), 0))
+	assert.Check(t, is.DeepEqual(mt.contents(t, "ab"), map[string]string{"a": "a", "b": "b"}))
+}
+
+func TestMergeExactMode(t *testing.T) {
+	mt := newMergeTest(t)
+	modes := map[string]uint32{
+		"/setuid": unix.S_IFREG | unix.S_ISUID | 0755,
+		"/setgid": unix.S_IFDIR | unix.S_ISGID | 0750,
+		"/sticky": unix.S_IFDIR | unix.S_ISVTX | 0777,
+		"/fifo":   unix.S_IFIFO | 0640,
+	}
+	mt.commit(t, "a", "", func(root string) error {
+		if err := os.WriteFile(filepath.Join(root, "setuid"), []byte("setuid"), 0600); err != nil {
+			return err
+		}
+		for _, p := range []string{"setgid", "sticky"} {
+			if err := os.Mkdir(filepath.Join(root, p), 0700); err != nil {
+				return err
+			}
+		}
+		return unix.Mkfifo(filepath.Join(root, "fifo"), 0600)
+	})
+
+	// rewriting the modes makes the merge copy the files instead of linking
+	// them, the modes must not depend on the umask they are created with
+	defer unix.Umask(unix.Umask(0777))
+	err := mt.sn.Merge(mt.ctx, "merged", []snapshot.Diff{{Upper: "a"}}, snapshot.WithChangeObserver(func(ctx context.Context, c *snapshot.MergeChange) error {
+		if mode, ok := modes[c.SubPath]; ok {
+			c.Mode = mode
+		}
+		return nil
+	}))
+	assert.NilError(t, err)
+
+	mntable, err := mt.sn.View(mt.ctx, "merged-view", "merged")
+	assert.NilError(t, err)
+	mounts, release, err := mntable.Mount()
+	assert.NilError(t, err)
+	defer release()
+	assert.NilError(t, mount.WithTempMount(mt.ctx, mounts, func(root string) error {
+		for p, mode := range modes {
+			var st unix.Stat_t
+			if err := unix.Lstat(filepath.Join(root, p), &st); err != nil {
+				return err
+			}
+			assert.Check(t, is.Equal(st.Mode, mode), p)
+		}
+		return nil
+	}))
+}
+
+func TestMergeBase(t *testing.T) {
+	mt := newMergeTest(t)
+	mt.commit(t, "base", "", writeFiles(map[string]string{"base/big": strings.Repeat("a", 1<<20)}))
+	mt.commit(t, "lib", "base", writeFiles(map[string]string{"base/lib": "lib"}))
+	mt.commit(t, "app1", "lib", writeFiles(map[string]string{"app1": "app1"}))
+	mt.commit(t, "app2", "lib", writeFiles(map[string]string{"app2": "app2"}))
+	mt.commit(t, "conf1", "lib", writeFiles(map[string]string{"conf": "1"}))
+	mt.commit(t, "conf2", "lib", writeFiles(map[string]string{"conf": "2"}))
+	mt.commit(t, "app-lib", "lib", writeFiles(map[string]string{"base/lib": "app"}))
+	mt.commit(t, "app-rm", "lib", func(root string) error {
+		return os.Remove(filepath.Join(root, "base/big"))
+	})
+
+	// chain returns the diffs of the merge input top, built on lib
+	chain := func(top string) []snapshot.Diff {
+		return []snapshot.Diff{{Upper: "base"}, {Lower: "base", Upper: "lib"}, {Lower: "lib", Upper: top}}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		inputs []string
+		parent string
+		files  map[string]string
+	}{
+		{
+			// the shared layers are applied once, the heavier chain of
+			// the last input becomes the base and the first input is
+			// moved after it
+			name:   "shared",
+			inputs: []string{"app1", "app2"},
+			parent: "app2",
+			files:  map[string]string{"base/big": strings.Repeat("a", 1<<20), "base/lib": "lib", "app1": "app1", "app2": "app2"},
+		},
+		{
+			// both inputs write the same file, so the first input can't
+			// be moved after the second one
+			name:   "conflict",
+			inputs: []string{"conf1", "conf2"},
+			parent: "conf1",
+			files:  map[string]string{"base/big": strings.Repeat("a", 1<<20), "base/lib": "lib", "conf": "2"},
+		},
+		{
+			// the first input changes a file of the shared layers, which
+			// the second input applies again on top of it
+			name:   "overwrite",
+			inputs: []string{"app-lib", "app2"},
+			parent: "app-lib",
+			files:  map[string]string{"base/big": strings.Repeat("a", 1<<20), "base/lib": "lib", "app2": "app2"},
+		},
+		{
+			// the whiteout of the first input is undone by the second
+			// input applying the shared layers again
+			name:   "whiteout-undone",
+			inputs: []string{"app-rm", "app2"},
+			parent: "app-rm",
+			files:  map[string]string{"base/lib": "lib", "base/big": strings.Repeat("a", 1<<20), "app2": "app2"},
+		},
+		{
+			// the chain of the last input, with its whiteout, becomes the
+			// base
+			name:   "whiteout",
+			inputs: []string{"app1", "app-rm"},
+			parent: "app-rm",
+			files:  map[string]string{"base/lib": "lib", "app1": "app1"},
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var diffs []snapshot.Diff
+			for _, input := range tc.inputs {
+				diffs = append(diffs, chain(input)...)
+			}
+			key := "merge-" + tc.name
+			assert.NilError(t, mt.sn.Merge(mt.ctx, key, diffs))
+			info, err := mt.sn.Stat(mt.ctx, key)
+			assert.NilError(t, err)
+			assert.Check(t, is.Equal(info.Parent, tc.parent))
+			assert.Check(t, is.DeepEqual(mt.contents(t, key), tc.files))
+		})
+	}
+}
+
+// BenchmarkMerge measures the merges applying the diff of a layer with
+// files files onto another layer. The allocs/change metric is the number of
+// allocations per file the differ and applier handle.
+func BenchmarkMerge(b *testing.B) {
+	for _, files := range []int{100, 1000} {
+		files := files
+		b.Run(fmt.Sprintf("files=%d", files), func(b *testing.B) {
+			mt := newMergeTest(b)
+			mt.commit(b, "base", "", writeFiles(map[string]string{"base": "base"}))
+			layer := map[string]string{}
+			for i := 0; i < files; i++ {
+				layer[fmt.Sprintf("dir%d/file%d", i%10, i)] = "data"
+			}
+			mt.commit(b, "layer", "", writeFiles(layer))
+			diffs := []snapshot.Diff{{Upper: "base"}, {Upper: "layer"}}
+
+			var before, after runtime.MemStats
+			b.ReportAllocs()
+			b.ResetTimer()
+			runtime.ReadMemStats(&before)
+			for i := 0; i < b.N; i++ {
+				key := fmt.Sprintf("merged%d", i)
+				if err := mt.sn.Merge(mt.ctx, key, diffs); err != nil {
+					b.Fatal(err)
+				}
+			}
+			runtime.ReadMemStats(&after)
+			// the changes are the files and their directories
+			changes := b.N * (files + 10)
+			b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(changes), "allocs/change")
+		})
+	}
+}
@@ -276,7 +276,15 @@ func (s *snapshotter) Mounts(ctx context.Context, key string) (snapshot.Mountabl
 	if err != nil {
 		return nil, err
 	}
+	dd, hasDirs := s.layerDirsDriver()
 	if l != nil {
+		if hasDirs {
+			id, err := getGraphID(l)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to get graphid %s", l.ChainID())
+			}
+			return s.dirsMountable(dd, id, true)
+		}
 		id := identity.NewID()
 		var rwlayer layer.RWLayer
 		return &mountable{
@@ -302,7 +310,10 @@ func (s *snapshotter) Mounts(ctx context.Context, key string) (snapshot.Mountabl
 		}, nil
 	}
 
-	id, _ := s.getGraphDriverID(key)
+	id, committed := s.getGraphDriverID(key)
+	if hasDirs {
+		return s.dirsMountable(dd, id, committed)
+	}
 
 	return &mountable{
 		idmap: s.opt.IdentityMapping,
@@ -322,6 +333,51 @@ func (s *snapshotter) Mounts(ctx context.Context, key string) (snapshot.Mountabl
 	}, nil
 }
 
+// dirsMountable returns a mountable of the graph driver layer id that mounts
+// the directories of the layer instead of the rootfs the driver mounts. This
+// lets the merges of buildkit hardlink files between layers and write into the
+// upper directory of layers directly.
+func (s *snapshotter) dirsMountable(dd graphdriver.LayerDirsDriver, id string, readonly bool) (snapshot.Mountable, error) {
+	lm, err := dd.GetMountOptions(id, "", readonly)
+	if err != nil {
+		return nil, err
+	}
+	m := mount.Mount{Type: lm.Type, Source: lm.Source, Options: lm.Options}
+	return &mountable{
+		idmap: s.opt.IdentityMapping,
+		acquire: func() ([]mount.Mount, func() error, error) {
+			return []mount.Mount{m}, func() error { return nil }, nil
+		},
+	}, nil
+}
+
+// layerDirsDriver returns the graph driver if the directories of its layers
+// can be mounted directly. With a remapped root, the work directory of a
+// writable mount must be chowned once it's mounted, which only the driver
+// itself does.
+func (s *snapshotter) layerDirsDriver() (graphdriver.LayerDirsDriver, bool) {
+	dd, ok := s.opt.GraphDriver.(graphdriver.LayerDirsDriver)
+	if !ok || !s.opt.IdentityMapping.Empty() {
+		return nil, false
+	}
+	return dd, true
+}
+
+// HardlinkMerge reports that merges can hardlink files between the layers of
+// graph drivers that expose their directories.
+func (s *snapshotter) HardlinkMerge() (bool, bool) {
+	_, ok := s.layerDirsDriver()
+	return ok, ok
+}
+
+// SupportsMerge reports that only graph drivers exposing their directories
+// can create merged snapshots. Merges of the other drivers are extracted
+// from the blobs of their layers instead.
+func (s *snapshotter) SupportsMerge() bool {
+	_, ok := s.layerDirsDriver()
+	return ok
+}
+
 func (s *snapshotter) Remove(ctx context.Context, key string) error {
 	return errors.Errorf("calling snapshot.remove is forbidden")
 }
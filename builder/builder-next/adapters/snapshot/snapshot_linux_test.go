@@ -0,0 +1,87 @@
+package snapshot
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/leases"
+	ctdmetadata "github.com/containerd/containerd/metadata"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/docker/docker/daemon/graphdriver"
+	_ "github.com/docker/docker/daemon/graphdriver/overlay2"
+	"github.com/docker/docker/layer"
+	"github.com/moby/buildkit/snapshot"
+	"github.com/moby/buildkit/util/leaseutil"
+	bolt "go.etcd.io/bbolt"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/skip"
+)
+
+type testSnapshotter struct {
+	root string
+	sn   snapshot.Snapshotter
+	lm   leases.Manager
+	mdb  *ctdmetadata.DB
+}
+
+// newTestSnapshotter returns a snapshotter on an overlay2 graph driver and
+// its lease manager, set up like the ones of the builder.
+func newTestSnapshotter(t testing.TB) *testSnapshotter {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	root := t.TempDir()
+
+	ls, err := layer.NewStoreFromOptions(layer.StoreOptions{
+		Root:                      root,
+		MetadataStorePathTemplate: filepath.Join(root, "image", "%s", "layerdb"),
+		GraphDriver:               "overlay2",
+	})
+	if err != nil {
+		t.Skipf("overlay2 not supported: %v", err)
+	}
+	t.Cleanup(func() { ls.Cleanup() })
+	driver := ls.(interface{ Driver() graphdriver.Driver }).Driver()
+
+	store, err := local.NewStore(filepath.Join(root, "content"))
+	assert.NilError(t, err)
+	db, err := bolt.Open(filepath.Join(root, "containerdmeta.db"), 0644, nil)
+	assert.NilError(t, err)
+	t.Cleanup(func() { db.Close() })
+	mdb := ctdmetadata.NewDB(db, store, map[string]snapshots.Snapshotter{})
+	lm := leaseutil.WithNamespace(ctdmetadata.NewLeaseManager(mdb), "buildkit")
+
+	sn, lm, err := NewSnapshotter(Opt{
+		GraphDriver: driver,
+		LayerStore:  ls,
+		Root:        root,
+	}, lm)
+	assert.NilError(t, err)
+	t.Cleanup(func() { sn.Close() })
+	return &testSnapshotter{root: root, sn: sn, lm: lm, mdb: mdb}
+}
+
+func TestProbeCapabilities(t *testing.T) {
+	ts := newTestSnapshotter(t)
+	ctx := context.Background()
+
+	caps, err := snapshot.ProbeCapabilities(ctx, ts.sn, ts.lm)
+	assert.NilError(t, err)
+	assert.Check(t, caps.Kernel != "")
+	assert.Check(t, caps.Filesystem != "")
+	assert.Check(t, caps.Hardlink)
+	t.Logf("capabilities: %v", caps.Names())
+
+	// the capabilities are only stale in another environment
+	env, err := snapshot.ProbeEnvironment(ctx, ts.sn, ts.lm)
+	assert.NilError(t, err)
+	assert.Check(t, !caps.Stale(env))
+	for _, other := range []snapshot.Capabilities{
+		{Kernel: "0.0.0", Rootless: env.Rootless, Filesystem: env.Filesystem},
+		{Kernel: env.Kernel, Rootless: !env.Rootless, Filesystem: env.Filesystem},
+		{Kernel: env.Kernel, Rootless: env.Rootless, Filesystem: "0:0:0"},
+	} {
+		assert.Check(t, caps.Stale(other), "%+v", other)
+	}
+}
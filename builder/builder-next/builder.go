@@ -58,6 +58,7 @@ var cacheFields = map[string]bool{
 	"inuse":       true,
 	"shared":      true,
 	"private":     true,
+	"platform":    true,
 	// fields from buildkit that are not exposed
 	"mutable":   false,
 	"immutable": false,
@@ -2,9 +2,14 @@ package buildkit
 
 import (
 	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/containerd/containerd/content/local"
 	ctdmetadata "github.com/containerd/containerd/metadata"
@@ -21,12 +26,15 @@ import (
 	"github.com/docker/docker/daemon/graphdriver"
 	units "github.com/docker/go-units"
 	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/cache/dedup"
 	"github.com/moby/buildkit/cache/metadata"
 	"github.com/moby/buildkit/cache/remotecache"
 	inlineremotecache "github.com/moby/buildkit/cache/remotecache/inline"
 	localremotecache "github.com/moby/buildkit/cache/remotecache/local"
+	registryremotecache "github.com/moby/buildkit/cache/remotecache/registry"
 	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/control"
+	"github.com/moby/buildkit/exporter/cachebundle"
 	"github.com/moby/buildkit/frontend"
 	dockerfile "github.com/moby/buildkit/frontend/dockerfile/builder"
 	"github.com/moby/buildkit/frontend/gateway"
@@ -34,10 +42,13 @@ import (
 	containerdsnapshot "github.com/moby/buildkit/snapshot/containerd"
 	"github.com/moby/buildkit/solver/bboltcachestorage"
 	"github.com/moby/buildkit/util/archutil"
+	"github.com/moby/buildkit/util/bklog"
+	"github.com/moby/buildkit/util/compression"
 	"github.com/moby/buildkit/util/entitlements"
 	"github.com/moby/buildkit/util/leaseutil"
 	"github.com/moby/buildkit/worker"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -63,6 +74,17 @@ func newController(rt http.RoundTripper, opt Opt) (*control.Controller, error) {
 		return nil, err
 	}
 
+	// blobs stored as chunks stay readable after DedupContent is disabled
+	var dedupStore *dedup.Store
+	dedupRoot := filepath.Join(root, "content-dedup")
+	if _, err := os.Stat(dedupRoot); opt.BuilderConfig.DedupContent || err == nil {
+		dedupStore, err = dedup.NewStore(dedupRoot, store)
+		if err != nil {
+			return nil, err
+		}
+		store = dedupStore
+	}
+
 	db, err := bolt.Open(filepath.Join(root, "containerdmeta.db"), 0644, nil)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -88,7 +110,27 @@ func newController(rt http.RoundTripper, opt Opt) (*control.Controller, error) {
 		return nil, err
 	}
 
-	md, err := metadata.NewStore(filepath.Join(root, "metadata_v2.db"))
+	var mdOpts []metadata.StoreOpt
+	if opt.BuilderConfig.CompactMetadata {
+		mdOpts = append(mdOpts, metadata.WithCompactEncoding(cache.InternedMetadataKeys...))
+	}
+	mdPath := filepath.Join(root, "metadata_v2.db")
+	if dir := opt.BuilderConfig.MetadataMirror; dir != "" {
+		m, err := metadata.NewFileMirror(dir)
+		if err != nil {
+			return nil, err
+		}
+		mdOpts = append(mdOpts, metadata.WithMirror(m))
+	}
+	md, err := metadata.NewStore(mdPath, mdOpts...)
+	if err != nil && opt.BuilderConfig.MetadataMirror != "" {
+		// a new store is restored from the mirror
+		logrus.WithError(err).Warn("failed to open build cache metadata, restoring it from mirror")
+		if err := os.Rename(mdPath, mdPath+".corrupt"); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		md, err = metadata.NewStore(mdPath, mdOpts...)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -103,17 +145,58 @@ func newController(rt http.RoundTripper, opt Opt) (*control.Controller, error) {
 		LayerGetter: layerGetter,
 	})
 
+	gcDeferDeadline, err := getGCDeferDeadline(opt.BuilderConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheVerifier, err := getCacheVerifier(opt.BuilderConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	compressionPolicy, err := getCompressionPolicy(opt.BuilderConfig, md)
+	if err != nil {
+		return nil, err
+	}
+
+	scrub, err := getScrubOpt(opt.BuilderConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if opt.BuilderConfig.AccessJournalSize < 0 {
+		return nil, errors.Errorf("Builder.AccessJournalSize config must not be negative, got %d", opt.BuilderConfig.AccessJournalSize)
+	}
+
+	var deduper cache.Deduper
+	if opt.BuilderConfig.DedupContent {
+		deduper = dedupStore
+	}
+
 	cm, err := cache.NewManager(cache.ManagerOpt{
-		Snapshotter:     snapshotter,
-		MetadataStore:   md,
-		PruneRefChecker: refChecker,
-		LeaseManager:    lm,
-		ContentStore:    store,
-		GarbageCollect:  mdb.GarbageCollect,
+		Snapshotter:       snapshotter,
+		MetadataStore:     md,
+		PruneRefChecker:   refChecker,
+		LeaseManager:      lm,
+		ContentStore:      store,
+		GarbageCollect:    mdb.GarbageCollect,
+		GCDeferDeadline:   gcDeferDeadline,
+		Dedup:             deduper,
+		CacheVerifier:     cacheVerifier,
+		UpperDirAccess:    opt.BuilderConfig.UpperDirAccess,
+		Scrub:             scrub,
+		AccessJournalSize: opt.BuilderConfig.AccessJournalSize,
+		LeaseTransaction: func(ctx context.Context, fn func(context.Context) error) error {
+			return mdb.Update(func(tx *bolt.Tx) error {
+				return fn(ctdmetadata.WithTransactionContext(ctx, tx))
+			})
+		},
 	})
 	if err != nil {
 		return nil, err
 	}
+	cacheContention.setSource(cm.ContentionStats)
 
 	src, err := containerimage.NewSource(containerimage.SourceOpt{
 		CacheAccessor:   cm,
@@ -147,6 +230,8 @@ func newController(rt http.RoundTripper, opt Opt) (*control.Controller, error) {
 		ImageStore:     dist.ImageStore,
 		ReferenceStore: dist.ReferenceStore,
 		Differ:         differ,
+		ContentStore:   store,
+		LeaseManager:   lm,
 	})
 	if err != nil {
 		return nil, err
@@ -162,6 +247,15 @@ func newController(rt http.RoundTripper, opt Opt) (*control.Controller, error) {
 		return nil, errors.Wrap(err, "could not get builder GC policy")
 	}
 
+	execQuota, err := getExecQuota(opt.BuilderConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := configureDecisionLog(opt.BuilderConfig); err != nil {
+		return nil, err
+	}
+
 	layers, ok := snapshotter.(mobyworker.LayerAccess)
 	if !ok {
 		return nil, errors.Errorf("snapshotter doesn't support differ")
@@ -189,6 +283,10 @@ func newController(rt http.RoundTripper, opt Opt) (*control.Controller, error) {
 		Transport:         rt,
 		Layers:            layers,
 		Platforms:         archutil.SupportedPlatforms(true),
+		ExecQuota:         execQuota,
+		Labels: map[string]string{
+			worker.LabelSnapshotterCaps: strings.Join(cm.Capabilities().Names(), ","),
+		},
 	}
 
 	wc := &worker.Controller{}
@@ -209,16 +307,111 @@ func newController(rt http.RoundTripper, opt Opt) (*control.Controller, error) {
 		Frontends:        frontends,
 		CacheKeyStorage:  cacheStorage,
 		ResolveCacheImporterFuncs: map[string]remotecache.ResolveCacheImporterFunc{
-			"registry": localinlinecache.ResolveCacheImporterFunc(opt.SessionManager, opt.RegistryHosts, store, dist.ReferenceStore, dist.ImageStore),
-			"local":    localremotecache.ResolveCacheImporterFunc(opt.SessionManager),
+			"registry":                 localinlinecache.ResolveCacheImporterFunc(opt.SessionManager, opt.RegistryHosts, store, dist.ReferenceStore, dist.ImageStore),
+			"local":                    localremotecache.ResolveCacheImporterFunc(opt.SessionManager),
+			client.ExporterCacheBundle: cachebundle.ResolveCacheImporterFunc(opt.SessionManager, lm),
 		},
 		ResolveCacheExporterFuncs: map[string]remotecache.ResolveCacheExporterFunc{
-			"inline": inlineremotecache.ResolveCacheExporterFunc(),
+			"inline":   inlineremotecache.ResolveCacheExporterFunc(),
+			"registry": registryremotecache.ResolveCacheExporterFuncWithPolicy(opt.SessionManager, opt.RegistryHosts, compressionPolicy),
 		},
 		Entitlements: getEntitlements(opt.BuilderConfig),
 	})
 }
 
+func getGCDeferDeadline(conf config.BuilderConfig) (time.Duration, error) {
+	if conf.GC.DeferDeadline == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(conf.GC.DeferDeadline)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not parse '%s' as Builder.GC.DeferDeadline config", conf.GC.DeferDeadline)
+	}
+	return d, nil
+}
+
+func getCacheVerifier(conf config.BuilderConfig) (cache.CacheVerifier, error) {
+	if len(conf.CacheTrustedKeys) == 0 {
+		return nil, nil
+	}
+	var keys []crypto.PublicKey
+	for _, p := range conf.CacheTrustedKeys {
+		dt, err := os.ReadFile(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read Builder.CacheTrustedKeys config")
+		}
+		block, _ := pem.Decode(dt)
+		if block == nil {
+			return nil, errors.Errorf("could not parse '%s' in Builder.CacheTrustedKeys config: no PEM data", p)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse '%s' in Builder.CacheTrustedKeys config", p)
+		}
+		keys = append(keys, key)
+	}
+	return cache.NewSignatureVerifier(keys...), nil
+}
+
+// getCompressionPolicy returns the policy selecting the compression of cache
+// exports to registries, which remembers the compressions each repository
+// accepted in md.
+func getCompressionPolicy(conf config.BuilderConfig, md *metadata.Store) (*compression.Policy, error) {
+	policy := &compression.Policy{
+		Overrides: map[string]compression.Type{},
+		History:   remotecache.NewCompressionHistory(md),
+	}
+	if conf.CacheExport.Compression != "" {
+		t := compression.Parse(conf.CacheExport.Compression)
+		if t == compression.UnknownCompression {
+			return nil, errors.Errorf("unknown compression '%s' in Builder.CacheExport.Compression config", conf.CacheExport.Compression)
+		}
+		policy.Default = &t
+	}
+	for target, c := range conf.CacheExport.CompressionOverrides {
+		t := compression.Parse(c)
+		if t == compression.UnknownCompression {
+			return nil, errors.Errorf("unknown compression '%s' for %s in Builder.CacheExport.CompressionOverrides config", c, target)
+		}
+		policy.Overrides[target] = t
+	}
+	return policy, nil
+}
+
+func getScrubOpt(conf config.BuilderConfig) (cache.ScrubOpt, error) {
+	if conf.Scrub.Fraction < 0 || conf.Scrub.Fraction > 1 {
+		return cache.ScrubOpt{}, errors.Errorf("Builder.Scrub.Fraction config must be between 0 and 1, got %v", conf.Scrub.Fraction)
+	}
+	return cache.ScrubOpt{
+		Fraction:   conf.Scrub.Fraction,
+		AutoDelete: conf.Scrub.AutoDelete,
+	}, nil
+}
+
+func configureDecisionLog(conf config.BuilderConfig) error {
+	level := logrus.DebugLevel
+	if conf.DecisionLog.Level != "" {
+		var err error
+		level, err = logrus.ParseLevel(conf.DecisionLog.Level)
+		if err != nil {
+			return errors.Wrapf(err, "could not parse '%s' as Builder.DecisionLog.Level config", conf.DecisionLog.Level)
+		}
+	}
+	bklog.ConfigureDecisionLog(level, conf.DecisionLog.SampleEvery)
+	return nil
+}
+
+func getExecQuota(conf config.BuilderConfig) (int64, error) {
+	if conf.ExecQuota == "" {
+		return 0, nil
+	}
+	b, err := units.RAMInBytes(conf.ExecQuota)
+	if err != nil {
+		return 0, errors.Wrapf(err, "could not parse '%s' as Builder.ExecQuota config", conf.ExecQuota)
+	}
+	return b, nil
+}
+
 func getGCPolicy(conf config.BuilderConfig, root string) ([]client.PruneInfo, error) {
 	var gcPolicy []client.PruneInfo
 	if conf.GC.Enabled {
@@ -7,15 +7,21 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/leases"
 	distref "github.com/docker/distribution/reference"
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/layer"
 	"github.com/docker/docker/reference"
+	"github.com/moby/buildkit/cache"
 	"github.com/moby/buildkit/exporter"
 	"github.com/moby/buildkit/exporter/containerimage/exptypes"
 	"github.com/moby/buildkit/util/compression"
 	"github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -34,6 +40,11 @@ type Opt struct {
 	ImageStore     image.Store
 	ReferenceStore reference.Store
 	Differ         Differ
+
+	// ContentStore and LeaseManager store the artifacts attached to the
+	// exported images as OCI referrers. Artifacts are ignored without them.
+	ContentStore content.Store
+	LeaseManager leases.Manager
 }
 
 type imageExporter struct {
@@ -122,8 +133,10 @@ func (e *imageExporterInstance) Export(ctx context.Context, inp exporter.Source,
 	}
 
 	// only one loop
-	for _, v := range inp.Refs {
+	var artifactsKey string
+	for k, v := range inp.Refs {
 		ref = v
+		artifactsKey = k
 	}
 
 	var config []byte
@@ -212,8 +225,44 @@ func (e *imageExporterInstance) Export(ctx context.Context, inp exporter.Source,
 		}
 	}
 
-	return map[string]string{
+	var referrers []byte
+	if artifacts := inp.Artifacts[artifactsKey]; len(artifacts) > 0 && e.opt.ContentStore != nil {
+		referrersDone := oneOffProgress(ctx, fmt.Sprintf("attaching %d artifacts", len(artifacts)))
+		descs, err := exporter.WriteReferrers(ctx, e.opt.ContentStore, e.opt.LeaseManager, ocispecs.Descriptor{
+			MediaType: images.MediaTypeDockerSchema2Config,
+			Digest:    configDigest,
+			Size:      int64(len(config)),
+		}, artifacts)
+		if err != nil {
+			return nil, referrersDone(err)
+		}
+		if referrers, err = json.Marshal(descs); err != nil {
+			return nil, referrersDone(err)
+		}
+		_ = referrersDone(nil)
+	}
+
+	if ref != nil {
+		// keep track of which images consumed the exported record
+		targets := []string{id.String()}
+		if e.opt.ReferenceStore != nil {
+			for _, targetName := range e.targetNames {
+				targets = append(targets, targetName.String())
+			}
+		}
+		for _, target := range targets {
+			if err := cache.RecordAccess(ref, cache.AccessExport, sessionID, target); err != nil {
+				logrus.WithError(err).Warnf("failed to record export of %s to %s", ref.ID(), target)
+			}
+		}
+	}
+
+	resp := map[string]string{
 		exptypes.ExporterImageConfigDigestKey: configDigest.String(),
 		exptypes.ExporterImageDigestKey:       id.String(),
-	}, nil
+	}
+	if referrers != nil {
+		resp[exptypes.ExporterImageReferrersKey] = string(referrers)
+	}
+	return resp, nil
 }
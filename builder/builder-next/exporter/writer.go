@@ -103,7 +103,7 @@ func patchImageConfig(dt []byte, dps []digest.Digest, history []ocispec.History,
 }
 
 func normalizeLayersAndHistory(diffs []digest.Digest, history []ocispec.History, ref cache.ImmutableRef) ([]digest.Digest, []ocispec.History) {
-	refMeta := getRefMetadata(ref, len(diffs))
+	refHistory := getRefHistory(ref, len(diffs))
 	var historyLayers int
 	for _, h := range history {
 		if !h.EmptyLayer {
@@ -130,12 +130,9 @@ func normalizeLayersAndHistory(diffs []digest.Digest, history []ocispec.History,
 
 	if len(diffs) > historyLayers {
 		// some history items are missing. add them based on the ref metadata
-		for _, md := range refMeta[historyLayers:] {
-			history = append(history, ocispec.History{
-				Created:   md.createdAt,
-				CreatedBy: md.description,
-				Comment:   "buildkit.exporter.image.v0",
-			})
+		for _, h := range refHistory[historyLayers:] {
+			h.Comment = "buildkit.exporter.image.v0"
+			history = append(history, h)
 		}
 	}
 
@@ -143,7 +140,7 @@ func normalizeLayersAndHistory(diffs []digest.Digest, history []ocispec.History,
 	for i, h := range history {
 		if !h.EmptyLayer {
 			if h.Created == nil {
-				h.Created = refMeta[layerIndex].createdAt
+				h.Created = refHistory[layerIndex].Created
 			}
 			layerIndex++
 		}
@@ -184,37 +181,16 @@ func normalizeLayersAndHistory(diffs []digest.Digest, history []ocispec.History,
 	return diffs, history
 }
 
-type refMetadata struct {
-	description string
-	createdAt   *time.Time
-}
-
-func getRefMetadata(ref cache.ImmutableRef, limit int) []refMetadata {
+// getRefHistory returns the history entries of the last limit layers of ref.
+func getRefHistory(ref cache.ImmutableRef, limit int) []ocispec.History {
 	if ref == nil {
-		return make([]refMetadata, limit)
-	}
-
-	layerChain := ref.LayerChain()
-	defer layerChain.Release(context.TODO())
-
-	if limit < len(layerChain) {
-		layerChain = layerChain[len(layerChain)-limit:]
+		return make([]ocispec.History, limit)
 	}
-
-	metas := make([]refMetadata, len(layerChain))
-	for i, layer := range layerChain {
-		meta := &metas[i]
-
-		if description := layer.GetDescription(); description != "" {
-			meta.description = description
-		} else {
-			meta.description = "created by buildkit" // shouldn't be shown but don't fail build
-		}
-
-		createdAt := layer.GetCreatedAt()
-		meta.createdAt = &createdAt
+	history := cache.LayerHistory(ref)
+	if limit < len(history) {
+		history = history[len(history)-limit:]
 	}
-	return metas
+	return history
 }
 
 func oneOffProgress(ctx context.Context, id string) func(err error) error {
@@ -0,0 +1,74 @@
+package buildkit
+
+import (
+	"sync"
+
+	metrics "github.com/docker/go-metrics"
+	"github.com/moby/buildkit/util/flightcontrol"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cacheContention exports the contention of the build cache of the latest
+// controller, see cache.Manager.ContentionStats.
+var cacheContention = newContentionCollector(metrics.NewNamespace("builder", "cache", nil))
+
+func init() {
+	metrics.Register(cacheContention.ns)
+}
+
+type contentionCollector struct {
+	ns *metrics.Namespace
+
+	mu    sync.RWMutex
+	stats func() map[string]flightcontrol.Stats
+
+	inflight *prometheus.Desc
+	waiters  *prometheus.Desc
+	waits    *prometheus.Desc
+	waitTime *prometheus.Desc
+	maxWait  *prometheus.Desc
+}
+
+func newContentionCollector(ns *metrics.Namespace) *contentionCollector {
+	c := &contentionCollector{
+		ns:       ns,
+		inflight: ns.NewDesc("inflight", "The number of keys of the build cache with a call in progress", metrics.Unit("keys"), "group"),
+		waiters:  ns.NewDesc("waiting", "The number of callers waiting on the call of another caller for the same key", metrics.Unit("callers"), "group"),
+		waits:    ns.NewDesc("waits", "The number of callers that waited on the call of another caller for the same key", metrics.Total, "group"),
+		waitTime: ns.NewDesc("wait_time", "The time callers spent waiting on the call of another caller for the same key", metrics.Seconds, "group"),
+		maxWait:  ns.NewDesc("max_wait", "The longest time a caller waited on the call of another caller for the same key", metrics.Seconds, "group"),
+	}
+	ns.Add(c)
+	return c
+}
+
+// setSource makes c export the stats returned by stats.
+func (c *contentionCollector) setSource(stats func() map[string]flightcontrol.Stats) {
+	c.mu.Lock()
+	c.stats = stats
+	c.mu.Unlock()
+}
+
+func (c *contentionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.inflight
+	ch <- c.waiters
+	ch <- c.waits
+	ch <- c.waitTime
+	ch <- c.maxWait
+}
+
+func (c *contentionCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.RLock()
+	stats := c.stats
+	c.mu.RUnlock()
+	if stats == nil {
+		return
+	}
+	for group, s := range stats() {
+		ch <- prometheus.MustNewConstMetric(c.inflight, prometheus.GaugeValue, float64(s.InflightKeys), group)
+		ch <- prometheus.MustNewConstMetric(c.waiters, prometheus.GaugeValue, float64(s.Waiters), group)
+		ch <- prometheus.MustNewConstMetric(c.waits, prometheus.CounterValue, float64(s.Waits), group)
+		ch <- prometheus.MustNewConstMetric(c.waitTime, prometheus.CounterValue, s.WaitTime.Seconds(), group)
+		ch <- prometheus.MustNewConstMetric(c.maxWait, prometheus.GaugeValue, s.MaxWait.Seconds(), group)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/moby/buildkit/client/llb"
 	"github.com/moby/buildkit/executor"
 	"github.com/moby/buildkit/exporter"
+	cachebundleexporter "github.com/moby/buildkit/exporter/cachebundle"
 	localexporter "github.com/moby/buildkit/exporter/local"
 	tarexporter "github.com/moby/buildkit/exporter/tar"
 	"github.com/moby/buildkit/frontend"
@@ -70,6 +71,9 @@ type Opt struct {
 	Exporter          exporter.Exporter
 	Layers            LayerAccess
 	Platforms         []ocispec.Platform
+	// ExecQuota is the maximum disk usage, in bytes, of the writable
+	// mounts of each exec. Zero disables the limit.
+	ExecQuota int64
 }
 
 // Worker is a local worker instance with dedicated snapshotter, cache, and so on.
@@ -189,6 +193,8 @@ func (w *Worker) ResolveOp(v solver.Vertex, s frontend.FrontendLLBBridge, sm *se
 			return ops.NewMergeOp(v, op, w)
 		case *pb.Op_Diff:
 			return ops.NewDiffOp(v, op, w)
+		case *pb.Op_Squash:
+			return ops.NewSquashOp(v, op, w)
 		}
 	}
 	return nil, errors.Errorf("could not resolve %v", v)
@@ -209,6 +215,11 @@ func (w *Worker) Prune(ctx context.Context, ch chan client.UsageInfo, info ...cl
 	return w.CacheManager().Prune(ctx, ch, info...)
 }
 
+// GC runs the scheduled garbage collection of the build cache
+func (w *Worker) GC(ctx context.Context, ch chan client.UsageInfo, info ...client.PruneInfo) error {
+	return w.CacheManager().GC(ctx, ch, info...)
+}
+
 // Exporter returns exporter by name
 func (w *Worker) Exporter(name string, sm *session.Manager) (exporter.Exporter, error) {
 	switch name {
@@ -222,6 +233,13 @@ func (w *Worker) Exporter(name string, sm *session.Manager) (exporter.Exporter,
 		return tarexporter.New(tarexporter.Opt{
 			SessionManager: sm,
 		})
+	case client.ExporterCacheBundle:
+		return cachebundleexporter.New(cachebundleexporter.Opt{
+			SessionManager: sm,
+			GetRemote: func(ctx context.Context, ref cache.ImmutableRef, s session.Group) (*solver.Remote, error) {
+				return w.GetRemote(ctx, ref, true, compression.Default, s)
+			},
+		})
 	default:
 		return nil, errors.Errorf("exporter %q could not be found", name)
 	}
@@ -344,6 +362,12 @@ func (w *Worker) FromRemote(ctx context.Context, remote *solver.Remote) (cache.I
 		return nil, errors.Errorf("invalid layer count mismatch %d vs %d", len(rootFS.DiffIDs), len(layers))
 	}
 
+	// let the cache manager verify the imported chainID to blob mappings
+	verify := make(map[digest.Digest]ocispec.Descriptor, len(rootFS.DiffIDs))
+	for i := range rootFS.DiffIDs {
+		verify[digest.Digest(layer.CreateChainID(rootFS.DiffIDs[:i+1]))] = remote.Descriptors[i]
+	}
+
 	for i := range rootFS.DiffIDs {
 		tm := time.Now()
 		if tmstr, ok := remote.Descriptors[i].Annotations[labelCreatedAt]; ok {
@@ -355,7 +379,7 @@ func (w *Worker) FromRemote(ctx context.Context, remote *solver.Remote) (cache.I
 		if v, ok := remote.Descriptors[i].Annotations["buildkit/description"]; ok {
 			descr = v
 		}
-		ref, err := w.getRef(ctx, rootFS.DiffIDs[:i+1], cache.WithDescription(descr), cache.WithCreationTime(tm))
+		ref, err := w.getRef(ctx, rootFS.DiffIDs[:i+1], cache.WithDescription(descr), cache.WithCreationTime(tm), cache.WithVerification(verify), cache.CompressionVariantPrefetchFor(remote.Descriptors[i]))
 		if err != nil {
 			return nil, err
 		}
@@ -378,6 +402,11 @@ func (w *Worker) CacheManager() cache.Manager {
 	return w.Opt.CacheManager
 }
 
+// ExecQuota returns the maximum disk usage of the writable mounts of execs
+func (w *Worker) ExecQuota() int64 {
+	return w.Opt.ExecQuota
+}
+
 type discardProgress struct{}
 
 func (*discardProgress) WriteProgress(_ pkgprogress.Progress) error {
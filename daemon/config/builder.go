@@ -59,6 +59,7 @@ type BuilderGCConfig struct {
 	Enabled            bool            `json:",omitempty"`
 	Policy             []BuilderGCRule `json:",omitempty"`
 	DefaultKeepStorage string          `json:",omitempty"`
+	DeferDeadline      string          `json:",omitempty"`
 }
 
 // BuilderEntitlements contains settings to enable/disable entitlements
@@ -67,8 +68,71 @@ type BuilderEntitlements struct {
 	SecurityInsecure *bool `json:"security-insecure,omitempty"`
 }
 
+// BuilderDecisionLog contains the config of the log of the decisions made by
+// the build cache, e.g. why a record was reused or pruned
+type BuilderDecisionLog struct {
+	// Level is the log level decisions are logged at, "debug" if empty.
+	Level string `json:",omitempty"`
+	// SampleEvery logs only every n-th decision of each kind.
+	SampleEvery int `json:",omitempty"`
+}
+
+// BuilderCacheExport contains the config of the export of the build cache to
+// registries
+type BuilderCacheExport struct {
+	// Compression is the compression of exports that don't set one, for
+	// registries of which nothing is known from previous exports, e.g.
+	// "zstd". It defaults to "gzip".
+	Compression string `json:",omitempty"`
+	// CompressionOverrides are the compressions of exports that don't set
+	// one, keyed by repository name or registry host.
+	CompressionOverrides map[string]string `json:",omitempty"`
+}
+
+// BuilderScrub contains the config of the background validation of the blobs
+// of the build cache against their digests
+type BuilderScrub struct {
+	// Fraction of the blobs validated per hour, between 0 and 1. Zero
+	// disables the validation.
+	Fraction float64 `json:",omitempty"`
+	// AutoDelete deletes corrupted blobs, so that they are pulled again
+	// when they are next used.
+	AutoDelete bool `json:",omitempty"`
+}
+
 // BuilderConfig contains config for the builder
 type BuilderConfig struct {
 	GC           BuilderGCConfig     `json:",omitempty"`
 	Entitlements BuilderEntitlements `json:",omitempty"`
+	// ExecQuota limits the disk usage of the writable mounts of each
+	// RUN step, e.g. "10GB". Steps exceeding it are stopped.
+	ExecQuota string `json:",omitempty"`
+	// CompactMetadata stores the metadata of the build cache in a compact
+	// encoding. The metadata is migrated when the daemon starts.
+	CompactMetadata bool `json:",omitempty"`
+	// MetadataMirror is a directory, preferably on another filesystem, the
+	// metadata of the build cache is mirrored to. The metadata is restored
+	// from it if it is lost or corrupted.
+	MetadataMirror string `json:",omitempty"`
+	// DedupContent stores the layer blobs created by the builder, and their
+	// compression variants, as chunks shared between blobs.
+	DedupContent bool `json:",omitempty"`
+	// CacheTrustedKeys are paths to PEM encoded public keys. If set, cache
+	// imported from registries is only trusted if the mapping of each of
+	// its layers to its blob is signed by one of these keys.
+	CacheTrustedKeys []string `json:",omitempty"`
+	// UpperDirAccess lets trusted integrations access the overlay upperdir
+	// of the writable layers of the build cache directly.
+	UpperDirAccess bool `json:",omitempty"`
+	// DecisionLog configures the log of the decisions of the build cache.
+	DecisionLog BuilderDecisionLog `json:",omitempty"`
+	// CacheExport configures the export of the build cache to registries.
+	CacheExport BuilderCacheExport `json:",omitempty"`
+	// Scrub configures the background validation of the blobs of the build
+	// cache.
+	Scrub BuilderScrub `json:",omitempty"`
+	// AccessJournalSize is the number of operations, e.g. mounts and
+	// exports, kept in the access journal of each record of the build
+	// cache. Zero disables the journal.
+	AccessJournalSize int `json:",omitempty"`
 }
@@ -130,6 +130,35 @@ type DiffGetterDriver interface {
 	DiffGetter(id string) (FileGetCloser, error)
 }
 
+// LayerDirsDriver is the interface for layered file system drivers that
+// store the changes of each layer in a directory and mount layers by stacking
+// the directories of the layer and its parents in an overlay mount. It allows
+// clients to access the directories of single layers, e.g. to hardlink files
+// between layers, and to mount layers themselves.
+type LayerDirsDriver interface {
+	Driver
+	// GetLowerDirs returns the directories of the parents of the layer,
+	// topmost first.
+	GetLowerDirs(id string) ([]string, error)
+	// GetUpperDir returns the directory holding the changes of the layer.
+	GetUpperDir(id string) (string, error)
+	// GetMountOptions returns how to mount the layer, read-only if
+	// readonly, without mounting it. It fails if the layer can't be
+	// mounted with such options, e.g. if they are too long.
+	GetMountOptions(id, mountLabel string, readonly bool) (LayerMount, error)
+}
+
+// LayerMount describes a mount of a layer returned by
+// LayerDirsDriver.GetMountOptions. The options of deep overlay mounts may not
+// fit in a page, they are meant to be mounted with the mount package of
+// containerd, which then mounts them relative to the common directory of
+// their lowers.
+type LayerMount struct {
+	Type    string
+	Source  string
+	Options []string
+}
+
 // FileGetCloser extends the storage.FileGetter interface with a Close method
 // for cleaning up.
 type FileGetCloser interface {
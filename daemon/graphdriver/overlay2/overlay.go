@@ -489,6 +489,106 @@ func (d *Driver) getLowerDirs(id string) ([]string, error) {
 	return lowersArray, nil
 }
 
+// GetLowerDirs returns the diff directories of the parents of the layer id,
+// topmost first.
+func (d *Driver) GetLowerDirs(id string) ([]string, error) {
+	return d.getLowerDirs(id)
+}
+
+// GetUpperDir returns the diff directory of the layer id.
+func (d *Driver) GetUpperDir(id string) (string, error) {
+	dir := d.dir(id)
+	if _, err := os.Stat(dir); err != nil {
+		return "", err
+	}
+	return path.Join(dir, diffDirName), nil
+}
+
+// GetMountOptions returns the mount Get creates for the layer id, without
+// mounting it, read-only if readonly. Layers without parents are bind mounts
+// of their diff directory. The lower directories are the diff directories of
+// the parents, or if the options don't fit in a page, their short links like
+// in Get so that mount.Mount can mount them relative to the directory of the
+// links.
+func (d *Driver) GetMountOptions(id, mountLabel string, readonly bool) (graphdriver.LayerMount, error) {
+	d.locker.Lock(id)
+	defer d.locker.Unlock(id)
+	dir := d.dir(id)
+	if _, err := os.Stat(dir); err != nil {
+		return graphdriver.LayerMount{}, err
+	}
+
+	diffDir := path.Join(dir, diffDirName)
+	workDir := path.Join(dir, workDirName)
+	lowers, err := os.ReadFile(path.Join(dir, lowerFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return graphdriver.LayerMount{}, err
+		}
+		m := graphdriver.LayerMount{Type: "bind", Source: diffDir, Options: []string{"rbind"}}
+		if readonly {
+			m.Options = append(m.Options, "ro")
+		}
+		return m, nil
+	}
+	diffLowers, err := d.getLowerDirs(id)
+	if err != nil {
+		return graphdriver.LayerMount{}, err
+	}
+	splitLowers := strings.Split(string(lowers), ":")
+	if readonly {
+		// the layer itself is a lower too, use its link so that all the
+		// lowers are in the same directory
+		lid, err := os.ReadFile(path.Join(dir, "link"))
+		if err != nil {
+			return graphdriver.LayerMount{}, err
+		}
+		diffLowers = append([]string{diffDir}, diffLowers...)
+		splitLowers = append([]string{path.Join(linkDir, string(lid))}, splitLowers...)
+	}
+
+	pageSize := unix.Getpagesize()
+	opts := d.mountOptions(diffLowers, diffDir, workDir, readonly, mountLabel)
+	if len(strings.Join(opts, ",")) > pageSize-1 {
+		// mount.Mount shortens the options of overlay mounts that don't fit
+		// in a page by mounting from the common directory of the lowers
+		absLowers := make([]string, len(splitLowers))
+		relLowers := make([]string, len(splitLowers))
+		for i, s := range splitLowers {
+			absLowers[i] = path.Join(d.home, s)
+			relLowers[i] = strings.TrimPrefix(s, linkDir+"/")
+		}
+		compact := d.mountOptions(relLowers, diffDir, workDir, readonly, mountLabel)
+		if l := len(strings.Join(compact, ",")); l > pageSize-1 {
+			return graphdriver.LayerMount{}, fmt.Errorf("cannot mount layer, mount label too large %d", l)
+		}
+		opts = d.mountOptions(absLowers, diffDir, workDir, readonly, mountLabel)
+	}
+	return graphdriver.LayerMount{Type: "overlay", Source: "overlay", Options: opts}, nil
+}
+
+// mountOptions returns the options of the overlay mount of a layer with the
+// lower directories lowers, shared by Get and GetMountOptions. Read-only
+// mounts have the diff directory of the layer as their topmost lower, the
+// others have diffDir and workDir as their upper and work directories.
+func (d *Driver) mountOptions(lowers []string, diffDir, workDir string, readonly bool, mountLabel string) []string {
+	var opts []string
+	for _, o := range strings.Split(indexOff+userxattr, ",") {
+		if o != "" {
+			opts = append(opts, o)
+		}
+	}
+	if readonly {
+		opts = append(opts, "lowerdir="+strings.Join(lowers, ":"))
+	} else {
+		opts = append(opts, "lowerdir="+strings.Join(lowers, ":"), "upperdir="+diffDir, "workdir="+workDir)
+	}
+	if l := label.FormatMountLabel("", mountLabel); l != "" {
+		opts = append(opts, l)
+	}
+	return opts
+}
+
 // Remove cleans the directories that are created for this id.
 func (d *Driver) Remove(id string) error {
 	if id == "" {
@@ -562,14 +662,10 @@ func (d *Driver) Get(id, mountLabel string) (_ containerfs.ContainerFS, retErr e
 		return nil, err
 	}
 
-	var opts string
 	if readonly {
-		opts = indexOff + userxattr + "lowerdir=" + diffDir + ":" + strings.Join(absLowers, ":")
-	} else {
-		opts = indexOff + userxattr + "lowerdir=" + strings.Join(absLowers, ":") + ",upperdir=" + diffDir + ",workdir=" + workDir
+		absLowers = append([]string{diffDir}, absLowers...)
 	}
-
-	mountData := label.FormatMountLabel(opts, mountLabel)
+	mountData := strings.Join(d.mountOptions(absLowers, diffDir, workDir, readonly, mountLabel), ",")
 	mount := unix.Mount
 	mountTarget := mergedDir
 
@@ -585,12 +681,11 @@ func (d *Driver) Get(id, mountLabel string) (_ containerfs.ContainerFS, retErr e
 	// fit within a page and relative links make the mount data much
 	// smaller at the expense of requiring a fork exec to chroot.
 	if len(mountData) > pageSize-1 {
+		relLowers := splitLowers
 		if readonly {
-			opts = indexOff + userxattr + "lowerdir=" + path.Join(id, diffDirName) + ":" + string(lowers)
-		} else {
-			opts = indexOff + userxattr + "lowerdir=" + string(lowers) + ",upperdir=" + path.Join(id, diffDirName) + ",workdir=" + path.Join(id, workDirName)
+			relLowers = append([]string{path.Join(id, diffDirName)}, splitLowers...)
 		}
-		mountData = label.FormatMountLabel(opts, mountLabel)
+		mountData = strings.Join(d.mountOptions(relLowers, path.Join(id, diffDirName), path.Join(id, workDirName), readonly, mountLabel), ",")
 		if len(mountData) > pageSize-1 {
 			return nil, fmt.Errorf("cannot mount layer, mount label too large %d", len(mountData))
 		}
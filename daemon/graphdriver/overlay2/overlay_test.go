@@ -4,13 +4,23 @@
 package overlay2 // import "github.com/docker/docker/daemon/graphdriver/overlay2"
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/containerd/containerd/mount"
 	"github.com/docker/docker/daemon/graphdriver"
 	"github.com/docker/docker/daemon/graphdriver/graphtest"
 	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/idtools"
 	"github.com/docker/docker/pkg/reexec"
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+	"gotest.tools/v3/skip"
 )
 
 func init() {
@@ -107,3 +117,56 @@ func BenchmarkDiff20Layers(b *testing.B) {
 func BenchmarkRead20Layers(b *testing.B) {
 	graphtest.DriverBenchDeepLayerRead(b, 20, driverName)
 }
+
+// TestOverlayDeepLayerMountOptions checks that the mounts returned by
+// GetMountOptions for layers with more lowers than fit in a page can be
+// mounted, read-only and writable.
+func TestOverlayDeepLayerMountOptions(t *testing.T) {
+	skip.If(t, os.Getuid() != 0, "skipping test that requires root")
+	drv, err := Init(t.TempDir(), nil, idtools.IdentityMapping{})
+	if err != nil {
+		t.Skipf("overlay2 not supported: %v", err)
+	}
+	defer drv.Cleanup()
+	d := drv.(*Driver)
+
+	parent := ""
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("layer%d", i)
+		assert.NilError(t, d.Create(id, parent, nil))
+		upper, err := d.GetUpperDir(id)
+		assert.NilError(t, err)
+		assert.NilError(t, os.WriteFile(filepath.Join(upper, id), []byte(id), 0644))
+		parent = id
+	}
+	assert.NilError(t, d.CreateReadWrite("rw", parent, nil))
+
+	for _, tc := range []struct {
+		id       string
+		readonly bool
+	}{
+		{id: parent, readonly: true},
+		{id: "rw"},
+	} {
+		lm, err := d.GetMountOptions(tc.id, "", tc.readonly)
+		assert.NilError(t, err)
+		assert.Assert(t, len(strings.Join(lm.Options, ",")) > unix.Getpagesize())
+
+		m := mount.Mount{Type: lm.Type, Source: lm.Source, Options: lm.Options}
+		assert.NilError(t, mount.WithTempMount(context.Background(), []mount.Mount{m}, func(root string) error {
+			for _, p := range []string{"layer0", parent} {
+				dt, err := os.ReadFile(filepath.Join(root, p))
+				assert.Check(t, err)
+				assert.Check(t, is.Equal(string(dt), p))
+			}
+			if !tc.readonly {
+				return os.WriteFile(filepath.Join(root, "new"), []byte("new"), 0644)
+			}
+			return nil
+		}), tc.id)
+	}
+	upper, err := d.GetUpperDir("rw")
+	assert.NilError(t, err)
+	_, err = os.Stat(filepath.Join(upper, "new"))
+	assert.Check(t, err)
+}
@@ -0,0 +1,317 @@
+package build // import "github.com/docker/docker/integration/build"
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	dclient "github.com/docker/docker/client"
+	"github.com/docker/docker/integration/internal/container"
+	"github.com/docker/docker/testutil/daemon"
+	"github.com/docker/docker/testutil/fakecontext"
+	"golang.org/x/sys/unix"
+	"gotest.tools/v3/assert"
+	is "gotest.tools/v3/assert/cmp"
+	"gotest.tools/v3/skip"
+)
+
+// mergeTestCases are Dockerfiles whose final stage merges the other stages
+// with COPY --link (a MergeOp) and then verifies the merged content with a
+// RUN check. A build fails if the merged content is wrong.
+var mergeTestCases = []struct {
+	name       string
+	dockerfile string
+}{
+	{
+		name: "overwrite",
+		dockerfile: `FROM busybox AS a
+RUN mkdir /out && echo a > /out/file
+FROM busybox AS b
+RUN mkdir /out && echo b > /out/file
+FROM busybox
+COPY --link --from=a /out /out
+COPY --link --from=b /out /out
+RUN test "$(cat /out/file)" = b`,
+	},
+	{
+		name: "directory merge",
+		dockerfile: `FROM busybox AS a
+RUN mkdir -p /out/dir && echo a > /out/dir/a
+FROM busybox AS b
+RUN mkdir -p /out/dir && echo b > /out/dir/b
+FROM busybox
+COPY --link --from=a /out /out
+COPY --link --from=b /out /out
+RUN test "$(cat /out/dir/a)" = a && test "$(cat /out/dir/b)" = b`,
+	},
+	{
+		name: "file replaced by directory",
+		dockerfile: `FROM busybox AS a
+RUN mkdir /out && echo a > /out/entry
+FROM busybox AS b
+RUN mkdir -p /out/entry && echo b > /out/entry/b
+FROM busybox
+COPY --link --from=a /out /out
+COPY --link --from=b /out /out
+RUN test -d /out/entry && test "$(cat /out/entry/b)" = b`,
+	},
+	{
+		name: "directory replaced by symlink",
+		dockerfile: `FROM busybox AS a
+RUN mkdir -p /out/entry && echo a > /out/entry/a
+FROM busybox AS b
+RUN mkdir /out && ln -s /target /out/entry
+FROM busybox
+COPY --link --from=a /out /out
+COPY --link --from=b /out /out
+RUN test "$(readlink /out/entry)" = /target`,
+	},
+	{
+		name: "hardlinks",
+		dockerfile: `FROM busybox AS a
+RUN mkdir /out && echo a > /out/file && ln /out/file /out/link
+FROM busybox AS b
+RUN mkdir /out && echo b > /out/other
+FROM busybox
+COPY --link --from=a /out /out
+COPY --link --from=b /out /out
+RUN test "$(stat -c %i /out/file)" = "$(stat -c %i /out/link)" && test "$(cat /out/other)" = b`,
+	},
+	{
+		name: "mode bits",
+		dockerfile: `FROM busybox AS a
+RUN mkdir /out && echo a > /out/setuid && chmod 4755 /out/setuid
+FROM busybox AS b
+RUN mkdir -p /out/sticky && chmod 1777 /out/sticky
+FROM busybox
+COPY --link --from=a /out /out
+COPY --link --from=b /out /out
+RUN test -u /out/setuid && test -k /out/sticky && test "$(stat -c %a /out/sticky)" = 1777`,
+	},
+}
+
+// referenceTestCases are Dockerfiles built twice: once merging the stages
+// with COPY --link, and once copying them with COPY, which applies the layers
+// one after another. The filesystem of the merged image must match the one of
+// this reference image entry by entry. {{copy}} is replaced by the copy
+// instruction, and the build context holds a file "cap" with a file
+// capability set.
+var referenceTestCases = []struct {
+	name       string
+	dockerfile string
+}{
+	{
+		name: "whiteout",
+		dockerfile: `FROM busybox AS a
+RUN mkdir /out && echo a > /out/file && echo a > /out/kept
+FROM busybox AS b
+RUN mkdir /out && echo b > /out/other
+FROM busybox
+{{copy}} --from=a /out /out
+RUN rm /out/file
+{{copy}} --from=b /out /out
+RUN test ! -e /out/file && test "$(cat /out/kept)" = a`,
+	},
+	{
+		name: "opaque directory",
+		dockerfile: `FROM busybox AS a
+RUN mkdir -p /out/dir && echo a > /out/dir/a
+FROM busybox AS b
+RUN mkdir /out && echo b > /out/b
+FROM busybox
+{{copy}} --from=a /out /out
+RUN rm -r /out/dir && mkdir /out/dir && echo c > /out/dir/c
+{{copy}} --from=b /out /out
+RUN test ! -e /out/dir/a && test "$(cat /out/dir/c)" = c`,
+	},
+	{
+		name: "xattrs",
+		dockerfile: `FROM busybox AS a
+COPY cap /out/cap
+FROM busybox AS b
+RUN mkdir /out && echo b > /out/b
+FROM busybox
+{{copy}} --from=a /out /out
+{{copy}} --from=b /out /out`,
+	},
+	{
+		name: "sparse file",
+		dockerfile: `FROM busybox AS a
+RUN mkdir /out && echo end | dd of=/out/sparse bs=1 seek=16777216
+FROM busybox AS b
+RUN mkdir /out && echo b > /out/b
+FROM busybox
+{{copy}} --from=a /out /out
+{{copy}} --from=b /out /out
+RUN test "$(stat -c %s /out/sparse)" = 16777220`,
+	},
+	{
+		name: "hardlinks and modes",
+		dockerfile: `FROM busybox AS a
+RUN mkdir -p /out/sticky && echo a > /out/file && ln /out/file /out/link && chmod 4755 /out/file && chmod 1777 /out/sticky
+FROM busybox AS b
+RUN mkdir /out && echo b > /out/b && chown 1000:1000 /out/b
+FROM busybox
+{{copy}} --from=a /out /out
+{{copy}} --from=b /out /out`,
+	},
+}
+
+// TestBuildMergeCorrectness runs every merge test case against a daemon for
+// each storage driver, as merges are implemented differently depending on
+// the snapshotter backing BuildKit (hardlink/copy based vs overlay based).
+func TestBuildMergeCorrectness(t *testing.T) {
+	skip.If(t, testEnv.DaemonInfo.OSType != "linux")
+	skip.If(t, testEnv.IsRemoteDaemon, "cannot start daemon on remote test run")
+	skip.If(t, testEnv.IsRootless, "rootless mode doesn't support all storage drivers")
+
+	for _, driver := range []string{"overlay2", "vfs"} {
+		driver := driver
+		t.Run(driver, func(t *testing.T) {
+			d := daemon.New(t, daemon.WithStorageDriver(driver))
+			d.StartWithBusybox(t)
+			defer d.Stop(t)
+
+			client := d.NewClientT(t)
+			defer client.Close()
+
+			for _, tc := range mergeTestCases {
+				tc := tc
+				t.Run(tc.name, func(t *testing.T) {
+					source := fakecontext.New(t, "", fakecontext.WithDockerfile(tc.dockerfile))
+					defer source.Close()
+					buildMergeImage(t, client, source, imageTag(t))
+				})
+			}
+		})
+	}
+}
+
+// TestBuildMergeMatchesReference compares the filesystem of images merging
+// their stages against the one of reference images copying them, for each
+// storage driver.
+func TestBuildMergeMatchesReference(t *testing.T) {
+	skip.If(t, testEnv.DaemonInfo.OSType != "linux")
+	skip.If(t, testEnv.IsRemoteDaemon, "cannot start daemon on remote test run")
+	skip.If(t, testEnv.IsRootless, "rootless mode doesn't support all storage drivers or file capabilities")
+
+	for _, driver := range []string{"overlay2", "vfs"} {
+		driver := driver
+		t.Run(driver, func(t *testing.T) {
+			d := daemon.New(t, daemon.WithStorageDriver(driver))
+			d.StartWithBusybox(t)
+			defer d.Stop(t)
+
+			client := d.NewClientT(t)
+			defer client.Close()
+
+			for _, tc := range referenceTestCases {
+				tc := tc
+				t.Run(tc.name, func(t *testing.T) {
+					var trees []map[string]string
+					for _, build := range []struct{ copy, tag string }{
+						{copy: "COPY --link", tag: "merged"},
+						{copy: "COPY", tag: "reference"},
+					} {
+						source := fakecontext.New(t, "",
+							fakecontext.WithDockerfile(strings.ReplaceAll(tc.dockerfile, "{{copy}}", build.copy)),
+							fakecontext.WithFile("cap", "cap"))
+						defer source.Close()
+						assert.NilError(t, unix.Setxattr(filepath.Join(source.Dir, "cap"), "security.capability", netBindServiceCap(), 0))
+
+						tag := imageTag(t) + "-" + build.tag
+						buildMergeImage(t, client, source, tag)
+						trees = append(trees, imageTree(t, client, tag, "out"))
+					}
+					assert.Check(t, is.DeepEqual(trees[0], trees[1]))
+				})
+			}
+		})
+	}
+}
+
+func imageTag(t *testing.T) string {
+	return strings.ToLower(strings.ReplaceAll(t.Name(), " ", "-"))
+}
+
+// buildMergeImage builds the image tag from source with BuildKit, failing
+// the test if the build fails.
+func buildMergeImage(t *testing.T, client dclient.APIClient, source *fakecontext.Fake, tag string) {
+	t.Helper()
+	resp, err := client.ImageBuild(context.Background(),
+		source.AsTarReader(t),
+		types.ImageBuildOptions{
+			Version: types.BuilderBuildKit,
+			NoCache: true,
+			Tags:    []string{tag},
+		})
+	assert.NilError(t, err)
+
+	out := bytes.NewBuffer(nil)
+	_, err = io.Copy(out, resp.Body)
+	_ = resp.Body.Close()
+	assert.NilError(t, err)
+	assert.Assert(t, !strings.Contains(out.String(), `"error"`), out.String())
+}
+
+// imageTree returns a description of the entries under dir in the
+// filesystem of image, keyed by path, as exported from a container.
+func imageTree(t *testing.T, client dclient.APIClient, image, dir string) map[string]string {
+	t.Helper()
+	ctx := context.Background()
+	id := container.Create(ctx, t, client, container.WithImage(image))
+	defer client.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true})
+
+	rc, err := client.ContainerExport(ctx, id)
+	assert.NilError(t, err)
+	defer rc.Close()
+
+	tree := map[string]string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		name := strings.TrimSuffix(hdr.Name, "/")
+		if name != dir && !strings.HasPrefix(name, dir+"/") {
+			continue
+		}
+		entry := fmt.Sprintf("type=%c mode=%o uid=%d gid=%d size=%d link=%s",
+			hdr.Typeflag, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Size, hdr.Linkname)
+		for k, v := range hdr.PAXRecords {
+			if strings.HasPrefix(k, "SCHILY.xattr.") {
+				entry += fmt.Sprintf(" %s=%x", k, v)
+			}
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			_, err := io.Copy(h, tr)
+			assert.NilError(t, err)
+			entry += fmt.Sprintf(" sha256=%x", h.Sum(nil))
+		}
+		tree[name] = entry
+	}
+	return tree
+}
+
+// netBindServiceCap returns a version 2 security.capability xattr permitting
+// CAP_NET_BIND_SERVICE.
+func netBindServiceCap() []byte {
+	const vfsCapRevision2 = 0x02000000
+	data := []uint32{vfsCapRevision2, 1 << unix.CAP_NET_BIND_SERVICE, 0, 0, 0}
+	b := make([]byte, 4*len(data))
+	for i, v := range data {
+		binary.LittleEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
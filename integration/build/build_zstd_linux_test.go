@@ -0,0 +1,137 @@
+package build // import "github.com/docker/docker/integration/build"
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/docker/docker/testutil/fakecontext"
+	"github.com/docker/docker/testutil/registry"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/skip"
+)
+
+// TestBuildFromZstdImage builds from images whose layer is zstd compressed,
+// with both the OCI and the docker zstd layer media types, pushed to a
+// registry.
+func TestBuildFromZstdImage(t *testing.T) {
+	skip.If(t, testEnv.DaemonInfo.OSType == "windows")
+	skip.If(t, testEnv.IsRemoteDaemon, "cannot run registry on remote test run")
+	defer setupTest(t)()
+
+	reg := registry.NewV2(t)
+	defer reg.Close()
+	client := testEnv.APIClient()
+
+	for _, tc := range []struct {
+		name              string
+		manifestMediaType string
+		configMediaType   string
+		layerMediaType    string
+	}{
+		{
+			name:              "oci",
+			manifestMediaType: ocispec.MediaTypeImageManifest,
+			configMediaType:   ocispec.MediaTypeImageConfig,
+			layerMediaType:    ocispec.MediaTypeImageLayer + "+zstd",
+		},
+		{
+			name:              "docker",
+			manifestMediaType: images.MediaTypeDockerSchema2Manifest,
+			configMediaType:   images.MediaTypeDockerSchema2Config,
+			layerMediaType:    images.MediaTypeDockerSchema2Layer + ".zstd",
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ref := registry.DefaultURL + "/zstd-" + tc.name + ":latest"
+			pushZstdImage(t, ref, tc.manifestMediaType, tc.configMediaType, tc.layerMediaType)
+
+			// COPY --link merges the pulled layer, COPY applies it
+			dockerfile := strings.ReplaceAll(`FROM busybox
+COPY --link --from={{ref}} /foo /linked
+COPY --from={{ref}} /foo /copied
+RUN test "$(cat /linked)" = foo && test "$(cat /copied)" = foo`, "{{ref}}", ref)
+			source := fakecontext.New(t, "", fakecontext.WithDockerfile(dockerfile))
+			defer source.Close()
+			buildMergeImage(t, client, source, imageTag(t))
+		})
+	}
+}
+
+// pushZstdImage pushes to ref an image for the platform of the test with a
+// single zstd compressed layer holding the file foo.
+func pushZstdImage(t *testing.T, ref, manifestMediaType, configMediaType, layerMediaType string) {
+	t.Helper()
+	ctx := context.Background()
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	assert.NilError(t, tw.WriteHeader(&tar.Header{Name: "foo", Mode: 0644, Size: 3, Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte("foo"))
+	assert.NilError(t, err)
+	assert.NilError(t, tw.Close())
+
+	var zBuf bytes.Buffer
+	zw, err := zstd.NewWriter(&zBuf)
+	assert.NilError(t, err)
+	_, err = zw.Write(tarBuf.Bytes())
+	assert.NilError(t, err)
+	assert.NilError(t, zw.Close())
+	layer := zBuf.Bytes()
+
+	platform := platforms.DefaultSpec()
+	config, err := json.Marshal(ocispec.Image{
+		Architecture: platform.Architecture,
+		OS:           platform.OS,
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{digest.FromBytes(tarBuf.Bytes())},
+		},
+	})
+	assert.NilError(t, err)
+
+	descriptor := func(mediaType string, dt []byte) ocispec.Descriptor {
+		return ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(dt), Size: int64(len(dt))}
+	}
+	manifest, err := json.Marshal(struct {
+		SchemaVersion int                  `json:"schemaVersion"`
+		MediaType     string               `json:"mediaType"`
+		Config        ocispec.Descriptor   `json:"config"`
+		Layers        []ocispec.Descriptor `json:"layers"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     manifestMediaType,
+		Config:        descriptor(configMediaType, config),
+		Layers:        []ocispec.Descriptor{descriptor(layerMediaType, layer)},
+	})
+	assert.NilError(t, err)
+
+	pusher, err := docker.NewResolver(docker.ResolverOptions{}).Pusher(ctx, ref)
+	assert.NilError(t, err)
+	for _, blob := range []struct {
+		mediaType string
+		dt        []byte
+	}{
+		{layerMediaType, layer},
+		{configMediaType, config},
+		{manifestMediaType, manifest},
+	} {
+		desc := descriptor(blob.mediaType, blob.dt)
+		w, err := pusher.Push(ctx, desc)
+		assert.NilError(t, err)
+		_, err = w.Write(blob.dt)
+		assert.NilError(t, err)
+		assert.NilError(t, w.Commit(ctx, desc.Size, desc.Digest))
+		assert.NilError(t, w.Close())
+	}
+}